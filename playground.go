@@ -1,25 +1,82 @@
 package main
 
 import (
+	"cmp"
 	"context"
+	"crypto/rand"
+	_ "embed"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"go/ast"
+	"go/build/constraint"
+	"go/format"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
 var (
-	goToolchain string
-	listenAddr  string
-	goCache     string
+	goToolchain   string
+	listenAddr    string
+	goCache       string
+	childMaxProcs int
+	defaultTheme  string
+	outputLimit   int
+	runSlots      chan struct{}
 )
 
+// intEnv returns the positive integer in the named environment
+// variable, or def if it is unset or invalid.
+func intEnv(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		slog.Warn("ignoring invalid setting", "name", name, "value", v)
+		return def
+	}
+	return n
+}
+
+// themeEnv returns the theme named by a DEFAULT_THEME value, or "dark"
+// if it is unset or names no theme.
+func themeEnv(v string) string {
+	if v != "light" && v != "dark" {
+		if v != "" {
+			slog.Warn("ignoring invalid setting", "name", "DEFAULT_THEME", "value", v)
+		}
+		return "dark"
+	}
+	return v
+}
+
 func init() {
+	// LOG_LEVEL takes slog's level names: debug, info, warn or error.
+	var level slog.Level
+	levelErr := level.UnmarshalText([]byte(cmp.Or(os.Getenv("LOG_LEVEL"), "info")))
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+	if levelErr != nil {
+		slog.Warn("ignoring invalid setting", "name", "LOG_LEVEL", "value", os.Getenv("LOG_LEVEL"))
+	}
+
 	goToolchain = os.Getenv("GOROOT")
 	if goToolchain == "" {
 		goToolchain = runtime.GOROOT()
@@ -31,100 +88,1413 @@ func init() {
 	}
 	listenAddr = ":" + listenAddr
 
+	// Cap the CPU available to user programs so that a busy snippet
+	// can't starve the server.
+	childMaxProcs = intEnv("CHILD_GOMAXPROCS", 2)
+
+	// The theme first-time visitors see; the page remembers a
+	// visitor's own choice in localStorage.
+	defaultTheme = themeEnv(os.Getenv("DEFAULT_THEME"))
+
+	outputLimit = intEnv("OUTPUT_LIMIT", 1<<20)
+
+	for path := range strings.SplitSeq(os.Getenv("BLOCKED_IMPORTS"), ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			blockedImports = append(blockedImports, path)
+		}
+	}
+
+	// Limit how many programs build and run at once, across all
+	// requests.
+	runSlots = make(chan struct{}, intEnv("MAX_RUNS", 2))
+
 	goCache = filepath.Join(os.TempDir(), "decimal64-playground-cache")
 	os.MkdirAll(goCache, 0755)
+
+	if path := os.Getenv("EXAMPLES_FILE"); path != "" {
+		loadExamples(path, os.Getenv("EXAMPLES_APPEND") != "")
+	}
+}
+
+// loadExamples reads a JSON array of examples from path and uses them
+// in place of the built-in examples, or after them if appendToBuiltin
+// is set. Any error leaves the built-in examples in place.
+func loadExamples(path string, appendToBuiltin bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		slog.Warn("using built-in examples", "path", path, "err", err)
+		return
+	}
+	var loaded []example
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		slog.Warn("using built-in examples", "path", path, "err", err)
+		return
+	}
+	if len(loaded) == 0 {
+		slog.Warn("using built-in examples", "path", path, "err", "no examples")
+		return
+	}
+	for i, ex := range loaded {
+		if ex.Name == "" || ex.Code == "" {
+			slog.Warn("using built-in examples", "path", path, "err", fmt.Sprintf("example %d needs a name and code", i))
+			return
+		}
+	}
+	if appendToBuiltin {
+		examples = append(examples, loaded...)
+	} else {
+		examples = loaded
+	}
+	slog.Info("loaded examples", "path", path, "count", len(loaded))
 }
 
 type runRequest struct {
 	Code string `json:"code"`
+
+	// KeepCR disables collapsing of carriage-return overwrites in the
+	// output; see collapseCR.
+	KeepCR bool `json:"keepCR,omitempty"`
+
+	// Mode selects optional processing of the program: "autoimport"
+	// adds missing standard library imports (see autoImport) and
+	// "deltas" reports float64 results alongside decimal arithmetic
+	// (see deltaInstrument) and "race" builds with the race detector.
+	Mode string `json:"mode,omitempty"`
+
+	// GODEBUG is passed to the program's environment after
+	// checkGODEBUG approves it.
+	GODEBUG string `json:"godebug,omitempty"`
 }
 
 type runResponse struct {
-	Output string `json:"output"`
-	Error  string `json:"error,omitempty"`
+	Output      string       `json:"output"`
+	Error       string       `json:"error,omitempty"`
+	Diagnostics []diagnostic `json:"diagnostics,omitempty"`
+	Truncated   bool         `json:"truncated,omitempty"`
+	Omitted     int64        `json:"omitted,omitempty"`
+	CompileMS   int64        `json:"compileMs"`
+	ExecMS      int64        `json:"execMs"`
+
+	// Resource use of the program, when the runner can measure it;
+	// see runResult.
+	MaxRSSKB int64 `json:"maxRssKb,omitempty"`
+	UserMS   int64 `json:"userMs,omitempty"`
+	SysMS    int64 `json:"sysMs,omitempty"`
+
+	// Notice is an informational message about the program, such as
+	// sandboxNotice's warning. It never affects whether the program runs.
+	Notice string `json:"notice,omitempty"`
+}
+
+// limitedBuffer keeps the first limit bytes written to it and counts
+// the rest, so a program that prints without bound can't exhaust
+// server memory.
+type limitedBuffer struct {
+	buf     []byte
+	limit   int
+	omitted int64
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if room := b.limit - len(b.buf); room < n {
+		room = max(room, 0)
+		b.omitted += int64(n - room)
+		p = p[:room]
+	}
+	b.buf = append(b.buf, p...)
+	return n, nil
+}
+
+// diagnostic is a compiler error located in the user's source.
+// Line and Col are 1-based.
+type diagnostic struct {
+	Line int    `json:"line"`
+	Col  int    `json:"col"`
+	Msg  string `json:"msg"`
+}
+
+// srcName is the file the user's program is written to inside its
+// temp directory. Tool output is rewritten so that positions refer to
+// it rather than to the server's filesystem.
+const srcName = "prog.go"
+
+// binName is the executable built from srcName.
+const binName = "prog"
+
+var diagRE = regexp.MustCompile(`(?m)^` + regexp.QuoteMeta(srcName) + `:(\d+):(\d+): (.*)$`)
+
+// parseDiagnostics extracts "prog.go:line:col: msg" lines from the
+// output of go run or go vet.
+func parseDiagnostics(out string) []diagnostic {
+	var diags []diagnostic
+	for _, m := range diagRE.FindAllStringSubmatch(out, -1) {
+		line, _ := strconv.Atoi(m[1])
+		col, _ := strconv.Atoi(m[2])
+		diags = append(diags, diagnostic{Line: line, Col: col, Msg: m[3]})
+	}
+	return diags
+}
+
+const runTimeout = 30 * time.Second
+
+// raceTimeout replaces runTimeout in race mode, since race-enabled
+// builds and runs are several times slower.
+const raceTimeout = 90 * time.Second
+
+// normalizeNewlines converts CRLF line endings, as pasted from Windows
+// editors, to LF, so that the source the tools see matches the
+// editor's lines and columns.
+func normalizeNewlines(code string) string {
+	return strings.ReplaceAll(code, "\r\n", "\n")
+}
+
+// stripBuildConstraints blanks out //go:build and // +build lines in
+// the file header. The playground always runs the submitted file as a
+// single program, so a pasted constraint that would exclude it (for
+// example "//go:build ignore") is dropped rather than honored. go run
+// already ignores constraints on files named on the command line;
+// stripping them keeps that true however the program is built. Lines
+// are blanked rather than removed so diagnostics keep their line
+// numbers.
+func stripBuildConstraints(src string) string {
+	lines := strings.Split(src, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, "package ") {
+			break
+		}
+		if constraint.IsGoBuild(line) || constraint.IsPlusBuild(line) {
+			lines[i] = ""
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// godebugAllowed lists the GODEBUG keys a run may set. They only
+// change what the runtime reports or how it schedules, not what the
+// program can reach.
+var godebugAllowed = []string{"asyncpreemptoff", "gctrace", "inittrace", "panicnil", "schedtrace"}
+
+// godebugValueRE matches the values accepted for godebugAllowed keys.
+var godebugValueRE = regexp.MustCompile(`^[0-9a-z]{1,16}$`)
+
+// checkGODEBUG reports whether every key=value setting in the
+// comma-separated s has a key in godebugAllowed and a plain value.
+func checkGODEBUG(s string) error {
+	for setting := range strings.SplitSeq(s, ",") {
+		key, value, ok := strings.Cut(setting, "=")
+		if !ok || !slices.Contains(godebugAllowed, key) || !godebugValueRE.MatchString(value) {
+			return fmt.Errorf("GODEBUG setting %q is not allowed; allowed keys are %s",
+				setting, strings.Join(godebugAllowed, ", "))
+		}
+	}
+	return nil
+}
+
+// blockedImports lists packages a program may not import: unsafe
+// steps outside the type system, runtime/debug changes runtime settings
+// such as the maximum stack size, and "C" would link C code into race
+// mode builds, which enable cgo. BLOCKED_IMPORTS adds to it. The server
+// doesn't otherwise limit what a program can do; see localRunner.
+var blockedImports = []string{"C", "runtime/debug", "unsafe"}
+
+// checkImports reports the first import in src that is in
+// blockedImports. Source that doesn't parse is left for the compiler
+// to report.
+func checkImports(src string) (diagnostic, bool) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, srcName, src, parser.ImportsOnly)
+	if err != nil {
+		return diagnostic{}, false
+	}
+	for _, spec := range f.Imports {
+		path, err := strconv.Unquote(spec.Path.Value)
+		if err != nil || !slices.Contains(blockedImports, path) {
+			continue
+		}
+		pos := fset.Position(spec.Path.Pos())
+		return diagnostic{
+			Line: pos.Line,
+			Col:  pos.Column,
+			Msg:  fmt.Sprintf("import %q is not allowed in the playground", path),
+		}, true
+	}
+	return diagnostic{}, false
+}
+
+// autoImportPaths maps package names that autoImport recognises to
+// their import paths.
+var autoImportPaths = map[string]string{
+	"bytes":   "bytes",
+	"errors":  "errors",
+	"fmt":     "fmt",
+	"json":    "encoding/json",
+	"log":     "log",
+	"maps":    "maps",
+	"math":    "math",
+	"os":      "os",
+	"reflect": "reflect",
+	"slices":  "slices",
+	"slog":    "log/slog",
+	"sort":    "sort",
+	"strconv": "strconv",
+	"strings": "strings",
+	"sync":    "sync",
+	"time":    "time",
+	"unicode": "unicode",
+}
+
+// autoImport adds imports for standard library packages that src
+// refers to (as pkg.Name) without importing. It is a small stand-in
+// for goimports covering autoImportPaths only. The imports go on the
+// package clause line so diagnostics keep their line numbers. Source
+// that does not parse is returned unchanged for the compiler to
+// report.
+func autoImport(src string) string {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, srcName, src, parser.SkipObjectResolution)
+	if err != nil {
+		return src
+	}
+	have := map[string]bool{}
+	for _, imp := range f.Imports {
+		path, _ := strconv.Unquote(imp.Path.Value)
+		name := path[strings.LastIndex(path, "/")+1:]
+		if imp.Name != nil {
+			name = imp.Name.Name
+		}
+		have[name] = true
+	}
+	// The type checker resolves identifiers by scope: a pkg naming a
+	// parameter, local or top-level declaration in scope resolves to
+	// it, while one that only matches a struct field, or a local
+	// elsewhere, resolves to nothing and needs the import.
+	info := &types.Info{Uses: make(map[*ast.Ident]types.Object)}
+	conf := types.Config{Importer: importer.Default(), Error: func(error) {}}
+	conf.Check("main", fset, []*ast.File{f}, info)
+	var missing []string
+	ast.Inspect(f, func(n ast.Node) bool {
+		sel, ok := n.(*ast.SelectorExpr)
+		if !ok {
+			return true
+		}
+		id, ok := sel.X.(*ast.Ident)
+		if !ok {
+			return true
+		}
+		path, known := autoImportPaths[id.Name]
+		if known && !have[id.Name] && info.Uses[id] == nil {
+			have[id.Name] = true
+			missing = append(missing, path)
+		}
+		return true
+	})
+	if len(missing) == 0 {
+		return src
+	}
+	slices.Sort(missing)
+	var b strings.Builder
+	for _, path := range missing {
+		fmt.Fprintf(&b, "; import %q", path)
+	}
+	off := fset.Position(f.Name.End()).Offset
+	return src[:off] + b.String() + src[off:]
+}
+
+// sandboxCalls lists, by import path, the calls that make sandboxNotice
+// warn. Only obvious filesystem writes and network use are flagged, to
+// keep false positives low.
+var sandboxCalls = map[string][]string{
+	"os":       {"Chdir", "Create", "Mkdir", "MkdirAll", "OpenFile", "Remove", "RemoveAll", "Rename", "WriteFile"},
+	"net":      {"Dial", "DialTimeout", "Listen", "ListenPacket"},
+	"net/http": {"Get", "Head", "ListenAndServe", "ListenAndServeTLS", "Post", "PostForm", "Serve"},
+}
+
+// sandboxNotice returns a notice if src calls something in
+// sandboxCalls, explaining what becomes of files the program writes and
+// that network use is unsupported. The notice describes behavior only;
+// localRunner enforces no filesystem or network restriction. It returns
+// "" otherwise, or if src does not parse.
+func sandboxNotice(src string) string {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, srcName, src, parser.SkipObjectResolution)
+	if err != nil {
+		return ""
+	}
+	pkgs := map[string]string{}
+	for _, imp := range f.Imports {
+		path, _ := strconv.Unquote(imp.Path.Value)
+		name := path[strings.LastIndex(path, "/")+1:]
+		if imp.Name != nil {
+			name = imp.Name.Name
+		}
+		pkgs[name] = path
+	}
+	var fs, network bool
+	ast.Inspect(f, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok {
+			return true
+		}
+		sel, ok := call.Fun.(*ast.SelectorExpr)
+		if !ok {
+			return true
+		}
+		id, ok := sel.X.(*ast.Ident)
+		if !ok {
+			return true
+		}
+		path := pkgs[id.Name]
+		if slices.Contains(sandboxCalls[path], sel.Sel.Name) {
+			if path == "os" {
+				fs = true
+			} else {
+				network = true
+			}
+		}
+		return true
+	})
+	switch {
+	case fs && network:
+		return "This program uses the filesystem and the network. Relative paths resolve to a temporary directory that is deleted after the run, and network use is not supported in the playground."
+	case fs:
+		return "This program writes to the filesystem. Relative paths resolve to a temporary directory that is deleted after the run."
+	case network:
+		return "This program uses the network. Network use is not supported in the playground, so it may not behave as it would locally."
+	}
+	return ""
+}
+
+// deltaInstrument rewrites each decimal arithmetic expression in src
+// so that, when evaluated, it also computes the same expression in
+// float64 and reports both results through _playgroundDelta64 or
+// _playgroundDelta128. Only outermost expressions of exactly decimal64
+// or decimal128 type whose operands are free of side effects are
+// instrumented, since the operands are evaluated twice. Each
+// replacement stays on the expression's first line, so diagnostics
+// keep their line numbers.
+func deltaInstrument(src string) string {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, srcName, src, 0)
+	if err != nil {
+		return src
+	}
+	info := &types.Info{Types: make(map[ast.Expr]types.TypeAndValue)}
+	conf := types.Config{Importer: importer.Default(), Error: func(error) {}}
+	conf.Check("main", fset, []*ast.File{f}, info)
+
+	offset := func(p token.Pos) int { return fset.Position(p).Offset }
+	text := func(e ast.Expr) string { return src[offset(e.Pos()):offset(e.End())] }
+	type edit struct {
+		start, end int
+		repl       string
+	}
+	var edits []edit
+	ast.Inspect(f, func(n ast.Node) bool {
+		bin, ok := n.(*ast.BinaryExpr)
+		if !ok {
+			return true
+		}
+		tv := info.Types[bin]
+		b, ok := tv.Type.(*types.Basic)
+		if !ok || tv.Value != nil || !isDecimal(b) {
+			return true
+		}
+		mirror, ok := floatMirror(info, bin, text)
+		if !ok {
+			return true
+		}
+		expr := strings.Join(strings.Fields(text(bin)), " ")
+		edits = append(edits, edit{offset(bin.Pos()), offset(bin.End()), fmt.Sprintf(
+			"_playgroundDelta%s(%d, %q, %s, %s)",
+			decimalSuffix(b), fset.Position(bin.Pos()).Line, expr, text(bin), mirror)})
+		return false
+	})
+	for _, e := range slices.Backward(edits) {
+		src = src[:e.start] + e.repl + src[e.end:]
+	}
+	return src
+}
+
+// floatMirror returns e rewritten to compute in float64, with each
+// operand converted, or false if an operand might have side effects.
+func floatMirror(info *types.Info, e ast.Expr, text func(ast.Expr) string) (string, bool) {
+	switch e := e.(type) {
+	case *ast.ParenExpr:
+		return floatMirror(info, e.X, text)
+	case *ast.UnaryExpr:
+		if e.Op != token.ADD && e.Op != token.SUB {
+			return "", false
+		}
+		m, ok := floatMirror(info, e.X, text)
+		return e.Op.String() + m, ok
+	case *ast.BinaryExpr:
+		x, okx := floatMirror(info, e.X, text)
+		y, oky := floatMirror(info, e.Y, text)
+		return "(" + x + " " + e.Op.String() + " " + y + ")", okx && oky
+	}
+	if !sideEffectFree(info, e) {
+		return "", false
+	}
+	return "float64(" + text(e) + ")", true
+}
+
+// sideEffectFree reports whether evaluating e only reads values:
+// identifiers, literals, field and index selections, and conversions
+// of these.
+func sideEffectFree(info *types.Info, e ast.Expr) bool {
+	switch e := e.(type) {
+	case *ast.Ident, *ast.BasicLit:
+		return true
+	case *ast.ParenExpr:
+		return sideEffectFree(info, e.X)
+	case *ast.SelectorExpr:
+		return sideEffectFree(info, e.X)
+	case *ast.IndexExpr:
+		return sideEffectFree(info, e.X) && sideEffectFree(info, e.Index)
+	case *ast.StarExpr:
+		return sideEffectFree(info, e.X)
+	case *ast.CallExpr:
+		return info.Types[e.Fun].IsType() && len(e.Args) == 1 && sideEffectFree(info, e.Args[0])
+	}
+	return false
+}
+
+// deltaName is the file that provides the functions deltaInstrument
+// calls.
+const deltaName = "decimal_deltas.go"
+
+// deltaSrc reports each instrumented expression as a dumpMarker line
+// holding a JSON object with the decimal result, the float64 result
+// and float64 minus decimal, computed in decimal128 from the float's
+// leading 34 digits. An expression is reported at most
+// _playgroundDeltaLimit times so loops don't flood the output. Every
+// name it declares starts with _playground, which user code is
+// unlikely to declare too.
+const deltaSrc = `package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+const _playgroundDeltaLimit = 10
+
+var _playgroundDeltaCounts struct {
+	sync.Mutex
+	m map[string]int
+}
+
+func _playgroundDelta64(line int, expr string, d decimal64, f float64) decimal64 {
+	_playgroundDelta(line, expr, fmt.Sprintf("%g", d), decimal128(d), f)
+	return d
+}
+
+func _playgroundDelta128(line int, expr string, d decimal128, f float64) decimal128 {
+	_playgroundDelta(line, expr, fmt.Sprintf("%g", d), d, f)
+	return d
+}
+
+func _playgroundDelta(line int, expr, dec string, d decimal128, f float64) {
+	key := fmt.Sprint(line, expr)
+	_playgroundDeltaCounts.Lock()
+	if _playgroundDeltaCounts.m == nil {
+		_playgroundDeltaCounts.m = map[string]int{}
+	}
+	_playgroundDeltaCounts.m[key]++
+	n := _playgroundDeltaCounts.m[key]
+	_playgroundDeltaCounts.Unlock()
+	if n > _playgroundDeltaLimit {
+		return
+	}
+	diff := "null"
+	if exact, err := strconv.ParseDecimal128(strconv.FormatFloat(f, 'e', 33, 64)); err == nil {
+		diff = strconv.Quote(fmt.Sprintf("%g", exact-d))
+	}
+	fmt.Printf("\x1e{\"delta\":true,\"line\":%d,\"expr\":%q,\"decimal\":%q,\"float\":%q,\"diff\":%s}\n",
+		line, expr, dec, strconv.FormatFloat(f, 'g', -1, 64), diff)
+}
+`
+
+// writeProgram writes code to srcName in a fresh temp directory,
+// which the caller must remove, and returns the files to build. If
+// the code calls decimal.Dump, or was rewritten by deltaInstrument,
+// the helpers it needs are added.
+func writeProgram(code string) (dir string, files []string, err error) {
+	dir, err = os.MkdirTemp("", "decimal64-play-*")
+	if err != nil {
+		return "", nil, err
+	}
+	src := stripBuildConstraints(code)
+	files = []string{srcName}
+	contents := []string{src}
+	if strings.Contains(src, "decimal.Dump(") {
+		files = append(files, dumpName)
+		contents = append(contents, dumpSrc)
+	}
+	if strings.Contains(src, "_playgroundDelta") {
+		files = append(files, deltaName)
+		contents = append(contents, deltaSrc)
+	}
+	for i, name := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents[i]), 0644); err != nil {
+			os.RemoveAll(dir)
+			return "", nil, err
+		}
+	}
+	return dir, files, nil
+}
+
+// dumpName is the file that provides decimal.Dump to programs that
+// use it.
+const dumpName = "decimal_dump.go"
+
+// dumpMarker starts each output line that dumpSrc and deltaSrc print
+// for the page to render rather than show as text. The helpers and
+// renderOutput spell it as the escape \x1e.
+const dumpMarker = "\x1e"
+
+// dumpSrc defines decimal.Dump, which prints a decimal64 together with
+// its BID encoding as a line starting with dumpMarker (U+001E) and
+// holding a JSON object. The page renders such lines as a value with
+// its coefficient and exponent beneath.
+const dumpSrc = `package main
+
+import (
+	"fmt"
+	"math"
+)
+
+var decimal playgroundDecimal
+
+type playgroundDecimal struct{}
+
+// Dump prints x and its BID encoding for the playground to display.
+func (playgroundDecimal) Dump(x decimal64) {
+	bits := math.Decimal64bits(x)
+	coeff, exp := "null", 0
+	switch {
+	case bits>>58&0x1F >= 0x1E: // Inf or NaN
+	case bits>>61&3 == 3:
+		coeff = fmt.Sprintf("\"%d\"", 1<<53|bits&(1<<51-1))
+		exp = int(bits>>51&0x3FF) - 398
+	default:
+		coeff = fmt.Sprintf("\"%d\"", bits&(1<<53-1))
+		exp = int(bits>>53&0x3FF) - 398
+	}
+	fmt.Printf("\x1e{\"value\":%q,\"coeff\":%s,\"exp\":%d,\"bits\":\"0x%016x\"}\n",
+		fmt.Sprintf("%#g", x), coeff, exp, bits)
+}
+`
+
+// goCommand returns a command that runs the decimal-enabled go tool
+// in dir.
+func goCommand(ctx context.Context, dir string, args ...string) *exec.Cmd {
+	goBin := filepath.Join(goToolchain, "bin", "go")
+	cmd := exec.CommandContext(ctx, goBin, args...)
+	inProcessGroup(cmd)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GOROOT="+goToolchain,
+		"GOEXPERIMENT=",
+		"CGO_ENABLED=0",
+		"GOCACHE="+goCache,
+	)
+	return cmd
+}
+
+// inProcessGroup makes cmd start in its own process group and, when its
+// context is cancelled, kill the whole group rather than just cmd, so a
+// timed-out build or program can't leave processes behind. WaitDelay
+// bounds how long Wait waits for output from processes that inherited
+// cmd's stdout or stderr after cmd itself exited.
+func inProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = time.Second
+}
+
+// cleanOutput strips the temp directory from paths in tool output, so
+// that both compile errors and stack traces refer to srcName.
+func cleanOutput(out, dir string) string {
+	out = strings.ReplaceAll(out, dir+string(filepath.Separator), "")
+	return strings.ReplaceAll(out, "./"+srcName, srcName)
+}
+
+// health records the outcome of the latest self-check attempt in
+// warmUp. Until the first attempt completes, checked is false and runs
+// are allowed.
+var health struct {
+	sync.Mutex
+	checked bool
+	err     error
+}
+
+// cacheMu guards goCache against being reset by warmUp while a build
+// is using it. Builds share it for reading; the go command makes
+// concurrent use of one cache safe by itself.
+var cacheMu sync.RWMutex
+
+func healthErr() error {
+	health.Lock()
+	defer health.Unlock()
+	return health.err
+}
+
+func setHealth(err error) {
+	health.Lock()
+	health.checked = true
+	health.err = err
+	health.Unlock()
+}
+
+// warmupRetry and maxWarmupRetry bound the backoff between self-check
+// attempts after a failure.
+const (
+	warmupRetry    = 5 * time.Second
+	maxWarmupRetry = 5 * time.Minute
+)
+
+// warmUp builds a trivial decimal program on startup, so that the
+// first user request doesn't pay the cold-compile cost and so that a
+// broken toolchain or cache is caught before users see cryptic
+// failures. If the build fails, the cache is wiped and the build
+// retried at once; if that fails too, or the build timed out, the
+// server is marked unhealthy and the build retried with backoff until
+// it passes.
+func warmUp() {
+	slog.Info("warming up build cache")
+	delay := warmupRetry
+	reset := false
+	for {
+		err := buildWarmup()
+		if err == nil {
+			break
+		}
+		// A timeout means a slow machine, not a corrupt cache, so
+		// wiping the cache would only make the next attempt slower.
+		if !reset && !errors.Is(err, context.DeadlineExceeded) {
+			slog.Warn("warmup build failed, resetting build cache", "dir", goCache, "err", err)
+			cacheMu.Lock()
+			if rmErr := os.RemoveAll(goCache); rmErr != nil {
+				slog.Error("removing build cache", "err", rmErr)
+			}
+			if mkErr := os.MkdirAll(goCache, 0755); mkErr != nil {
+				slog.Error("recreating build cache", "err", mkErr)
+			}
+			cacheMu.Unlock()
+			reset = true
+			continue
+		}
+		setHealth(err)
+		slog.Error("self-check failed, refusing runs until it passes", "err", err, "retry_in", delay)
+		time.Sleep(delay)
+		delay = min(2*delay, maxWarmupRetry)
+	}
+	setHealth(nil)
+	slog.Info("build cache warm")
+}
+
+func buildWarmup() error {
+	dir, files, err := writeProgram(`package main; func main() { var d decimal64 = 1; _ = d }`)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+	cacheMu.RLock()
+	out, err := goCommand(ctx, dir, append([]string{"build", "-o", binName}, files...)...).CombinedOutput()
+	cacheMu.RUnlock()
+	if ctx.Err() != nil {
+		return fmt.Errorf("warmup build: %w", ctx.Err())
+	}
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// handleHealth reports 200 once the self-check has passed and 503
+// while it is still running or while its latest attempt has failed.
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	health.Lock()
+	checked, err := health.checked, health.err
+	health.Unlock()
+	switch {
+	case !checked:
+		http.Error(w, "starting", http.StatusServiceUnavailable)
+	case err != nil:
+		http.Error(w, "unhealthy: "+err.Error(), http.StatusServiceUnavailable)
+	default:
+		fmt.Fprintln(w, "ok")
+	}
+}
+
+type requestIDKey struct{}
+
+// requestID returns the ID withRequestID gave the request carrying
+// ctx, or "" outside one.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// statusRecorder remembers the status code written through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(code int) {
+	if rec.status == 0 {
+		rec.status = code
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+func (rec *statusRecorder) Unwrap() http.ResponseWriter { return rec.ResponseWriter }
+
+// withRequestID gives each request a fresh ID, returned to the client
+// in X-Request-ID and available to handlers through requestID, and
+// logs the request's start and end under it.
+func withRequestID(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := rand.Text()
+		w.Header().Set("X-Request-ID", id)
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+
+		slog.InfoContext(r.Context(), "request start", "request_id", id, "method", r.Method, "path", r.URL.Path)
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r)
+		slog.InfoContext(r.Context(), "request end",
+			"request_id", id,
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", cmp.Or(rec.status, http.StatusOK),
+			"duration", time.Since(start))
+	})
+}
+
+func handleRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req runRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, loggedRun(r.Context(), req))
+}
+
+// loggedRun calls runProgram and logs the run's outcome, size and
+// timings under the request's ID. Any extra attrs are added to the
+// log line.
+func loggedRun(ctx context.Context, req runRequest, extra ...any) runResponse {
+	start := time.Now()
+	resp := runProgram(ctx, req)
+	outcome := "ok"
+	if resp.Error != "" {
+		outcome = "error"
+	}
+	attrs := append([]any{
+		"request_id", requestID(ctx),
+		"outcome", outcome,
+		"mode", req.Mode,
+		"code_bytes", len(req.Code),
+		"duration", time.Since(start),
+		"compile_ms", resp.CompileMS,
+		"exec_ms", resp.ExecMS,
+	}, extra...)
+	if resp.Error != "" {
+		attrs = append(attrs, "err", resp.Error)
+	}
+	slog.InfoContext(ctx, "run", attrs...)
+	return resp
+}
+
+// runProgram builds and runs req.Code once a run slot is free. The
+// build and the run share a single runTimeout, and each phase is
+// timed. Each run gets its own directory for the source and binary, so
+// concurrent runs of identical code share nothing writable but the
+// build cache.
+func runProgram(ctx context.Context, req runRequest) runResponse {
+	if err := healthErr(); err != nil {
+		return runResponse{Error: "playground unavailable: toolchain self-check failed"}
+	}
+
+	// Requests that would be refused anyway are refused before they
+	// wait for a run slot.
+	code := normalizeNewlines(req.Code)
+	if d, ok := checkImports(code); ok {
+		return runResponse{Error: d.Msg, Diagnostics: []diagnostic{d}}
+	}
+	if req.GODEBUG != "" {
+		if err := checkGODEBUG(req.GODEBUG); err != nil {
+			return runResponse{Error: err.Error()}
+		}
+	}
+	timeout := runTimeout
+	switch req.Mode {
+	case "", "autoimport", "deltas":
+	case "race":
+		timeout = raceTimeout
+	default:
+		return runResponse{Error: fmt.Sprintf("unknown mode %q", req.Mode)}
+	}
+
+	select {
+	case runSlots <- struct{}{}:
+		defer func() { <-runSlots }()
+	case <-ctx.Done():
+		return runResponse{Error: "cancelled while waiting to run"}
+	}
+
+	// The rewrites type-check the program, so unlike the checks above
+	// they are work a run slot should bound.
+	switch req.Mode {
+	case "autoimport":
+		code = autoImport(code)
+	case "deltas":
+		code = deltaInstrument(code)
+	}
+
+	dir, files, err := writeProgram(code)
+	if err != nil {
+		return runResponse{Error: "internal error: " + err.Error()}
+	}
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	out := &limitedBuffer{limit: outputLimit}
+	resp := runResponse{Notice: sandboxNotice(code)}
+	args := []string{"build", "-o", binName}
+	if req.Mode == "race" {
+		args = append(args, "-race")
+	}
+	build := goCommand(ctx, dir, append(args, files...)...)
+	if req.Mode == "race" {
+		// The race runtime needs cgo; later entries win in Env.
+		build.Env = append(build.Env, "CGO_ENABLED=1")
+	}
+	build.Stdout = out
+	build.Stderr = out
+	start := time.Now()
+	cacheMu.RLock()
+	err = build.Run()
+	cacheMu.RUnlock()
+	resp.CompileMS = time.Since(start).Milliseconds()
+	built := err == nil
+
+	if built {
+		job := runJob{Dir: dir, Binary: filepath.Join(dir, binName), Output: out}
+		job.Env = []string{"GOMAXPROCS=" + strconv.Itoa(childMaxProcs)}
+		if req.GODEBUG != "" {
+			job.Env = append(job.Env, "GODEBUG="+req.GODEBUG)
+		}
+		var result runResult
+		result, err = programRunner.Run(ctx, job)
+		resp.ExecMS = result.Elapsed.Milliseconds()
+		resp.MaxRSSKB = result.MaxRSSKB
+		resp.UserMS = result.User.Milliseconds()
+		resp.SysMS = result.Sys.Milliseconds()
+	}
+
+	resp.Output = cleanOutput(string(out.buf), dir)
+	if !req.KeepCR {
+		resp.Output = collapseCR(resp.Output)
+	}
+	resp.Truncated = out.omitted > 0
+	resp.Omitted = out.omitted
+	if err != nil {
+		switch {
+		case ctx.Err() == context.DeadlineExceeded:
+			resp.Error = fmt.Sprintf("program timed out (%ds limit)", int(timeout.Seconds()))
+		case req.Mode == "race" && !built && raceUnavailable(resp.Output):
+			resp.Error = "race detector unavailable on this server: " + strings.TrimSpace(resp.Output)
+			resp.Output = ""
+		case strings.Contains(resp.Output, raceMsg):
+			resp.Error = "data race detected"
+		case strings.Contains(resp.Output, deadlockMsg):
+			resp.Error = "program deadlocked: all goroutines are blocked"
+		default:
+			resp.Error = err.Error()
+			resp.Diagnostics = parseDiagnostics(resp.Output)
+		}
+	}
+	return resp
+}
+
+// A runner executes a built program. localRunner, the default, runs it
+// as a child process of the server. A deployment that wants stronger
+// isolation, such as gVisor or a Firecracker VM, can set programRunner
+// to a runner that copies job.Dir into the sandbox and runs it there.
+type runner interface {
+	// Run runs job.Binary until it exits or ctx is done, writing its
+	// stdout and stderr to job.Output. The error is the program's exit
+	// status as for exec.Cmd.Run, or why it couldn't be started.
+	Run(ctx context.Context, job runJob) (runResult, error)
+}
+
+// runJob describes one program execution.
+type runJob struct {
+	Dir    string    // working directory, holding the binary
+	Binary string    // path of the executable
+	Env    []string  // added to the runner's own environment
+	Output io.Writer // receives stdout and stderr
+}
+
+// runResult holds what a runner measured about an execution. Fields a
+// runner can't measure are left zero.
+type runResult struct {
+	Elapsed   time.Duration
+	MaxRSSKB  int64 // peak resident set size, in KiB
+	User, Sys time.Duration
+}
+
+var programRunner runner = localRunner{}
+
+// localRunner runs programs as child processes in their own process
+// group, limited only by the job's context.
+type localRunner struct{}
+
+func (localRunner) Run(ctx context.Context, job runJob) (runResult, error) {
+	cmd := exec.CommandContext(ctx, job.Binary)
+	inProcessGroup(cmd)
+	cmd.Dir = job.Dir
+	cmd.Env = append(os.Environ(), job.Env...)
+	cmd.Stdout = job.Output
+	cmd.Stderr = job.Output
+	start := time.Now()
+	err := cmd.Run()
+	result := runResult{Elapsed: time.Since(start)}
+	if cmd.ProcessState != nil {
+		result.User = cmd.ProcessState.UserTime()
+		result.Sys = cmd.ProcessState.SystemTime()
+		if ru, ok := cmd.ProcessState.SysUsage().(*syscall.Rusage); ok {
+			result.MaxRSSKB = int64(ru.Maxrss)
+			if runtime.GOOS == "darwin" {
+				result.MaxRSSKB /= 1024 // bytes there, KiB on Linux
+			}
+		}
+	}
+	if cmd.Process != nil {
+		// Anything the program started dies with it.
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	if errors.Is(err, exec.ErrWaitDelay) {
+		// The program exited cleanly, but a process it started kept
+		// its output open.
+		err = nil
+	}
+	return result, err
+}
+
+// deadlockMsg is the runtime's fatal error when every goroutine is
+// blocked. It is reported separately from timeouts, which mean the
+// program was still busy when it was killed.
+const deadlockMsg = "fatal error: all goroutines are asleep - deadlock!"
+
+// raceMsg heads each report from the race detector. A program that
+// races exits with status 66 after printing one.
+const raceMsg = "WARNING: DATA RACE"
+
+// raceUnavailable reports whether build output says the toolchain
+// can't build with -race here: the platform isn't supported, or cgo
+// has no C compiler.
+func raceUnavailable(out string) bool {
+	return strings.Contains(out, "-race requires cgo") ||
+		strings.Contains(out, "-race is not supported") ||
+		strings.Contains(out, "C compiler")
+}
+
+// collapseCR replays carriage returns the way a terminal would: text
+// after a \r overwrites the start of the current line, leaving any
+// longer tail in place. Progress bars and spinners then show only
+// their final state instead of every frame run together.
+func collapseCR(s string) string {
+	if !strings.Contains(s, "\r") {
+		return s
+	}
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		if !strings.Contains(line, "\r") {
+			continue
+		}
+		var buf []rune
+		col := 0
+		for _, r := range line {
+			if r == '\r' {
+				col = 0
+				continue
+			}
+			if col < len(buf) {
+				buf[col] = r
+			} else {
+				buf = append(buf, r)
+			}
+			col++
+		}
+		lines[i] = string(buf)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// maxBatch caps the number of snippets in one /api/run-batch request.
+const maxBatch = 10
+
+type batchRequest struct {
+	Snippets []snippet `json:"snippets"`
+}
+
+type snippet struct {
+	Name string `json:"name"`
+	Code string `json:"code"`
+}
+
+type batchResult struct {
+	Name string `json:"name"`
+	runResponse
+}
+
+// handleRunBatch runs several snippets concurrently, subject to the
+// same run slots and per-program timeout as handleRun, and returns
+// their results in request order.
+func handleRunBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req batchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if len(req.Snippets) > maxBatch {
+		http.Error(w, fmt.Sprintf("at most %d snippets per batch", maxBatch), http.StatusBadRequest)
+		return
+	}
+
+	results := make([]batchResult, len(req.Snippets))
+	var wg sync.WaitGroup
+	for i, sn := range req.Snippets {
+		wg.Go(func() {
+			resp := loggedRun(r.Context(), runRequest{Code: sn.Code}, "batch_index", i, "snippet", sn.Name)
+			results[i] = batchResult{Name: sn.Name, runResponse: resp}
+		})
+	}
+	wg.Wait()
+	writeJSON(w, results)
+}
+
+type formatResponse struct {
+	Code  string `json:"code,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// handleFormat gofmts the submitted program. Source that doesn't parse
+// is reported as an error and left for the caller to run or fix.
+func handleFormat(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req runRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	out, err := format.Source([]byte(normalizeNewlines(req.Code)))
+	if err != nil {
+		writeJSON(w, formatResponse{Error: err.Error()})
+		return
+	}
+	writeJSON(w, formatResponse{Code: string(out)})
+}
+
+// handleVet runs go vet over the submitted program, followed by the
+// decimal-specific checks in decimalVet.
+func handleVet(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req runRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if err := healthErr(); err != nil {
+		writeJSON(w, runResponse{Error: "playground unavailable: toolchain self-check failed"})
+		return
+	}
+
+	// go vet builds the program's dependencies, so it takes a run slot
+	// and shares the build cache just as runProgram does.
+	select {
+	case runSlots <- struct{}{}:
+		defer func() { <-runSlots }()
+	case <-r.Context().Done():
+		writeJSON(w, runResponse{Error: "cancelled while waiting to vet"})
+		return
+	}
+
+	code := normalizeNewlines(req.Code)
+	dir, files, err := writeProgram(code)
+	if err != nil {
+		writeJSON(w, runResponse{Error: "internal error: " + err.Error()})
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithTimeout(r.Context(), runTimeout)
+	defer cancel()
+
+	// go vet exits non-zero when it reports anything, so its status
+	// says nothing the diagnostics don't.
+	cacheMu.RLock()
+	out, _ := goCommand(ctx, dir, append([]string{"vet"}, files...)...).CombinedOutput()
+	cacheMu.RUnlock()
+	resp := runResponse{Output: cleanOutput(string(out), dir)}
+	if ctx.Err() == context.DeadlineExceeded {
+		resp.Error = "vet timed out (30s limit)"
+		writeJSON(w, resp)
+		return
+	}
+	resp.Diagnostics = parseDiagnostics(resp.Output)
+
+	for _, d := range decimalVet(stripBuildConstraints(code)) {
+		resp.Output += fmt.Sprintf("%s:%d:%d: %s\n", srcName, d.Line, d.Col, d.Msg)
+		resp.Diagnostics = append(resp.Diagnostics, d)
+	}
+	slices.SortStableFunc(resp.Diagnostics, func(a, b diagnostic) int {
+		return cmp.Or(cmp.Compare(a.Line, b.Line), cmp.Compare(a.Col, b.Col))
+	})
+	writeJSON(w, resp)
+}
+
+// A decimalCheck inspects one node of a type-checked program and
+// reports decimal-specific problems through report.
+type decimalCheck func(info *types.Info, n ast.Node, report func(n ast.Node, msg string))
+
+var decimalChecks = []decimalCheck{
+	checkLossyConversion,
+	checkFloatMathCall,
+	checkDecimalRemainder,
+	checkMixedArithmetic,
+}
+
+// decimalVet type-checks src and runs decimalChecks over it. Syntax
+// and type errors are left to the compiler and go vet; the checks only
+// see what the type checker could resolve.
+func decimalVet(src string) []diagnostic {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, srcName, src, 0)
+	if err != nil {
+		return nil
+	}
+	info := &types.Info{
+		Types: make(map[ast.Expr]types.TypeAndValue),
+		Uses:  make(map[*ast.Ident]types.Object),
+	}
+	conf := types.Config{Importer: importer.Default(), Error: func(error) {}}
+	conf.Check("main", fset, []*ast.File{f}, info)
+
+	var diags []diagnostic
+	report := func(n ast.Node, msg string) {
+		pos := fset.Position(n.Pos())
+		diags = append(diags, diagnostic{Line: pos.Line, Col: pos.Column, Msg: msg})
+	}
+	ast.Inspect(f, func(n ast.Node) bool {
+		if n != nil {
+			for _, check := range decimalChecks {
+				check(info, n, report)
+			}
+		}
+		return true
+	})
+	return diags
+}
+
+// isDecimal reports whether t is decimal64, decimal128 or a type
+// defined on one of them.
+func isDecimal(t types.Type) bool {
+	if t == nil {
+		return false
+	}
+	b, ok := t.Underlying().(*types.Basic)
+	return ok && (b.Name() == "decimal64" || b.Name() == "decimal128")
+}
+
+// decimalSuffix returns the suffix of math functions for the decimal
+// type t: "64" or "128".
+func decimalSuffix(t types.Type) string {
+	if t.Underlying().(*types.Basic).Name() == "decimal128" {
+		return "128"
+	}
+	return "64"
+}
+
+// isBinaryFloat reports whether t is float32, float64 or a type
+// defined on one of them.
+func isBinaryFloat(t types.Type) bool {
+	if t == nil {
+		return false
+	}
+	b, ok := t.Underlying().(*types.Basic)
+	return ok && (b.Kind() == types.Float32 || b.Kind() == types.Float64)
+}
+
+// checkLossyConversion flags run-time conversions from binary to
+// decimal floating point. decimal64(0.1) is exact because the constant
+// keeps its decimal form, but decimal64(f) for a float64 variable f
+// converts whatever binary approximation f holds.
+func checkLossyConversion(info *types.Info, n ast.Node, report func(ast.Node, string)) {
+	call, ok := n.(*ast.CallExpr)
+	if !ok || len(call.Args) != 1 {
+		return
+	}
+	fun := info.Types[call.Fun]
+	if !fun.IsType() || !isDecimal(fun.Type) {
+		return
+	}
+	arg := info.Types[call.Args[0]]
+	if arg.Value != nil || !isBinaryFloat(arg.Type) {
+		return
+	}
+	report(call, fmt.Sprintf(
+		"conversion from %s to %s may be inexact; start from a decimal constant or strconv.ParseDecimal64 instead",
+		arg.Type, fun.Type))
 }
 
-const runTimeout = 30 * time.Second
+// decimalMath lists the math functions on float64 that have decimal
+// counterparts, named with the suffix 64 or 128 (math.Floor64).
+var decimalMath = map[string]bool{
+	"Abs":         true,
+	"Ceil":        true,
+	"FMA":         true,
+	"Floor":       true,
+	"Round":       true,
+	"RoundToEven": true,
+	"Trunc":       true,
+}
 
-func init() {
-	// Warm up the build cache on startup so the first user request
-	// doesn't pay the cold-compile cost.
-	go func() {
-		log.Println("warming up build cache...")
-		src := `package main; func main() { var d decimal64 = 1; _ = d }`
-		f, err := os.CreateTemp("", "warmup-*.go")
-		if err != nil {
-			return
+// paramType returns the type of the parameter of sig that receives
+// argument i of a call, or nil if there is none. ellipsis reports
+// whether the call passes its last argument with "...".
+func paramType(sig *types.Signature, i int, ellipsis bool) types.Type {
+	params := sig.Params()
+	if sig.Variadic() && i >= params.Len()-1 {
+		last := params.At(params.Len() - 1).Type()
+		if s, ok := last.Underlying().(*types.Slice); ok && !ellipsis {
+			return s.Elem()
 		}
-		defer os.Remove(f.Name())
-		f.WriteString(src)
-		f.Close()
-
-		goBin := filepath.Join(goToolchain, "bin", "go")
-		ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
-		defer cancel()
-		cmd := exec.CommandContext(ctx, goBin, "run", f.Name())
-		cmd.Env = append(os.Environ(),
-			"GOROOT="+goToolchain,
-			"GOEXPERIMENT=",
-			"CGO_ENABLED=0",
-			"GOCACHE="+goCache,
-		)
-		cmd.CombinedOutput()
-		log.Println("build cache warm")
-	}()
+		return last
+	}
+	if i < params.Len() {
+		return params.At(i).Type()
+	}
+	return nil
 }
 
-func handleRun(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+// checkFloatMathCall flags decimals passed to float64 parameters of
+// math functions, such as math.Floor(d), naming the decimal function
+// to use instead where there is one. The compiler only reports a type
+// mismatch. Decimal functions such as math.Quantize64 are left alone.
+func checkFloatMathCall(info *types.Info, n ast.Node, report func(ast.Node, string)) {
+	call, ok := n.(*ast.CallExpr)
+	if !ok {
 		return
 	}
-
-	var req runRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "bad request", http.StatusBadRequest)
+	sel, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok {
 		return
 	}
-
-	// Write source to temp file.
-	f, err := os.CreateTemp("", "decimal64-play-*.go")
-	if err != nil {
-		writeJSON(w, runResponse{Error: "internal error: " + err.Error()})
+	fn, ok := info.Uses[sel.Sel].(*types.Func)
+	if !ok || fn.Pkg() == nil || fn.Pkg().Path() != "math" {
 		return
 	}
-	defer os.Remove(f.Name())
-
-	if _, err := f.WriteString(req.Code); err != nil {
-		f.Close()
-		writeJSON(w, runResponse{Error: "internal error: " + err.Error()})
+	sig := fn.Type().(*types.Signature)
+	for i, arg := range call.Args {
+		t := info.Types[arg].Type
+		p := paramType(sig, i, call.Ellipsis.IsValid())
+		if !isDecimal(t) || p == nil || !types.Identical(p, types.Typ[types.Float64]) {
+			continue
+		}
+		if decimalMath[fn.Name()] {
+			report(call, fmt.Sprintf("math.%s takes float64; use math.%s%s for %s",
+				fn.Name(), fn.Name(), decimalSuffix(t), t))
+		} else {
+			report(call, fmt.Sprintf("math.%s takes float64 and has no %s counterpart; convert with float64(x) only if an approximate result is acceptable",
+				fn.Name(), t))
+		}
 		return
 	}
-	f.Close()
-
-	// Run with timeout.
-	ctx, cancel := context.WithTimeout(r.Context(), runTimeout)
-	defer cancel()
-
-	goBin := filepath.Join(goToolchain, "bin", "go")
-	cmd := exec.CommandContext(ctx, goBin, "run", f.Name())
-	cmd.Env = append(os.Environ(),
-		"GOROOT="+goToolchain,
-		"GOEXPERIMENT=",
-		"CGO_ENABLED=0",
-		"GOCACHE="+goCache,
-	)
+}
 
-	out, err := cmd.CombinedOutput()
-	resp := runResponse{Output: string(out)}
-	if err != nil {
-		if ctx.Err() == context.DeadlineExceeded {
-			resp.Error = "program timed out (30s limit)"
-		} else {
-			resp.Error = err.Error()
+// checkDecimalRemainder flags % and %= on decimals, which, as for
+// binary floating point, are not defined.
+func checkDecimalRemainder(info *types.Info, n ast.Node, report func(ast.Node, string)) {
+	var x ast.Expr
+	switch n := n.(type) {
+	case *ast.BinaryExpr:
+		if n.Op != token.REM {
+			return
+		}
+		x = n.X
+	case *ast.AssignStmt:
+		if n.Tok != token.REM_ASSIGN {
+			return
 		}
+		x = n.Lhs[0]
+	default:
+		return
 	}
-	writeJSON(w, resp)
+	if t := info.Types[x].Type; isDecimal(t) {
+		report(n, fmt.Sprintf("operator %% is not defined on %s; compute x - math.Trunc%s(x/y)*y instead",
+			t, decimalSuffix(t)))
+	}
+}
+
+// checkMixedArithmetic flags binary operations between a decimal and a
+// binary floating-point value. Neither converts implicitly, and the
+// fix depends on which representation the result should have.
+func checkMixedArithmetic(info *types.Info, n ast.Node, report func(ast.Node, string)) {
+	bin, ok := n.(*ast.BinaryExpr)
+	if !ok {
+		return
+	}
+	x, y := info.Types[bin.X], info.Types[bin.Y]
+	if isBinaryFloat(x.Type) && isDecimal(y.Type) {
+		x, y = y, x
+	}
+	if !isDecimal(x.Type) || !isBinaryFloat(y.Type) || y.Value != nil {
+		return
+	}
+	report(bin, fmt.Sprintf(
+		"mixed %s and %s operands; keep the value decimal from the start, since converting a %s to %s carries its binary error",
+		x.Type, y.Type, y.Type, x.Type))
 }
 
 func writeJSON(w http.ResponseWriter, v any) {
@@ -132,21 +1502,196 @@ func writeJSON(w http.ResponseWriter, v any) {
 	json.NewEncoder(w).Encode(v)
 }
 
+// preload is code the page should open with instead of the saved
+// buffer, along with any notice to show in the output pane.
+type preload struct {
+	Code   string `json:"code,omitempty"`
+	Notice string `json:"notice,omitempty"`
+}
+
 func handleIndex(w http.ResponseWriter, r *http.Request) {
+	var pre *preload
+	if id := r.URL.Query().Get("gist"); id != "" {
+		pre = gistPreload(r.Context(), id)
+	}
+	renderIndex(w, pre, false)
+}
+
+// handleEmbed serves a read-only variant of the page for iframes: a
+// compact header, no examples menu, and nothing written to
+// localStorage. The snippet is the gist named by id, or the built-in
+// example numbered by example.
+func handleEmbed(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var pre *preload
+	switch {
+	case q.Get("id") != "":
+		pre = gistPreload(r.Context(), q.Get("id"))
+	case q.Get("example") != "":
+		n, err := strconv.Atoi(q.Get("example"))
+		if err != nil || n < 0 || n >= len(examples) {
+			http.Error(w, "no such example", http.StatusNotFound)
+			return
+		}
+		pre = &preload{Code: examples[n].Code}
+	default:
+		http.Error(w, "embed needs an id or example parameter", http.StatusBadRequest)
+		return
+	}
+	renderIndex(w, pre, true)
+}
+
+// gistPreload fetches a gist for the page, falling back to the default
+// example with a notice if that fails.
+func gistPreload(ctx context.Context, id string) *preload {
+	code, err := fetchGist(ctx, id)
+	if err != nil {
+		slog.WarnContext(ctx, "loading gist", "request_id", requestID(ctx), "gist", id, "err", err)
+		return &preload{
+			Code:   examples[0].Code,
+			Notice: fmt.Sprintf("Could not load gist %s (%v); showing the default example.", id, err),
+		}
+	}
+	return &preload{Code: code}
+}
+
+const examplesSelectHTML = `<select id="examples" class="examples-select" onchange="loadExample()" title="Alt+&larr; / Alt+&rarr; to cycle examples">
+  </select>`
+
+func renderIndex(w http.ResponseWriter, pre *preload, embed bool) {
+	bodyClass, selectHTML := "", examplesSelectHTML
+	if embed {
+		bodyClass, selectHTML = "embed", ""
+	}
+
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	// Inject examples as a JSON array so escapes are preserved.
 	examplesJSON, _ := json.Marshal(examples)
-	html := fmt.Sprintf(indexHTML, string(examplesJSON))
+	preloadJSON, _ := json.Marshal(pre)
+	html := fmt.Sprintf(indexHTML, defaultTheme, embed, bodyClass, selectHTML,
+		string(examplesJSON), string(preloadJSON), embed)
 	fmt.Fprint(w, html)
 }
 
+// gistAPI and gistClient are where and how gists are fetched. Tests
+// point them at a local server.
+var (
+	gistAPI    = "https://api.github.com/gists/"
+	gistClient = http.DefaultClient
+)
+
+const (
+	gistTimeout  = 5 * time.Second
+	gistMaxBytes = 64 << 10
+	gistCacheTTL = 5 * time.Minute
+)
+
+var gistIDRE = regexp.MustCompile(`^[0-9a-fA-F]{1,64}$`)
+
+type gistEntry struct {
+	code    string
+	err     error
+	fetched time.Time
+}
+
+// gistCache holds recent fetches, including failures, so that a
+// popular link doesn't hit the GitHub API on every page load.
+var gistCache = struct {
+	sync.Mutex
+	m map[string]gistEntry
+}{m: make(map[string]gistEntry)}
+
+// fetchGist returns the contents of the first .go file, by name, in
+// the GitHub gist with the given id.
+func fetchGist(ctx context.Context, id string) (string, error) {
+	if !gistIDRE.MatchString(id) {
+		return "", fmt.Errorf("invalid gist id")
+	}
+
+	gistCache.Lock()
+	e, ok := gistCache.m[id]
+	gistCache.Unlock()
+	if ok && time.Since(e.fetched) < gistCacheTTL {
+		return e.code, e.err
+	}
+
+	code, err := fetchGistUncached(ctx, id)
+
+	gistCache.Lock()
+	now := time.Now()
+	for k, e := range gistCache.m {
+		if now.Sub(e.fetched) >= gistCacheTTL {
+			delete(gistCache.m, k)
+		}
+	}
+	gistCache.m[id] = gistEntry{code: code, err: err, fetched: now}
+	gistCache.Unlock()
+	return code, err
+}
+
+func fetchGistUncached(ctx context.Context, id string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, gistTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, gistAPI+id, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	resp, err := gistClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("GitHub returned %s", resp.Status)
+	}
+
+	var gist struct {
+		Files map[string]struct {
+			Size      int    `json:"size"`
+			Truncated bool   `json:"truncated"`
+			Content   string `json:"content"`
+		} `json:"files"`
+	}
+	// The response carries every file's content, so allow some slack
+	// beyond the cap on the file we actually use.
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 16*gistMaxBytes)).Decode(&gist); err != nil {
+		return "", fmt.Errorf("decoding gist: %v", err)
+	}
+
+	var names []string
+	for name := range gist.Files {
+		if strings.HasSuffix(name, ".go") {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return "", fmt.Errorf("no .go file in gist")
+	}
+	slices.Sort(names)
+	file := gist.Files[names[0]]
+	if file.Size > gistMaxBytes || file.Truncated {
+		return "", fmt.Errorf("%s is larger than %d bytes", names[0], gistMaxBytes)
+	}
+	return file.Content, nil
+}
+
 func main() {
+	go warmUp()
+
 	http.HandleFunc("/", handleIndex)
+	http.HandleFunc("/embed", handleEmbed)
+	http.HandleFunc("/healthz", handleHealth)
 	http.HandleFunc("/api/run", handleRun)
+	http.HandleFunc("/api/run-batch", handleRunBatch)
+	http.HandleFunc("/api/vet", handleVet)
+	http.HandleFunc("/api/format", handleFormat)
 
-	log.Printf("decimal64 playground listening on http://localhost%s", listenAddr)
-	log.Printf("using GOROOT=%s", goToolchain)
-	log.Fatal(http.ListenAndServe(listenAddr, nil))
+	slog.Info("decimal64 playground listening", "url", "http://localhost"+listenAddr, "goroot", goToolchain)
+	err := http.ListenAndServe(listenAddr, withRequestID(http.DefaultServeMux))
+	slog.Error("server stopped", "err", err)
+	os.Exit(1)
 }
 
 type example struct {
@@ -154,6 +1699,13 @@ type example struct {
 	Code string `json:"code"`
 }
 
+// quantumValidateSrc is the end-to-end validation program CI runs
+// against the toolchain, offered as an example so visitors can check
+// the quantum rules for themselves.
+//
+//go:embed tests/quantum_validate.go
+var quantumValidateSrc string
+
 var examples = []example{
 	{
 		Name: "Hello, decimal64",
@@ -286,14 +1838,67 @@ func main() {
 }
 `,
 	},
+	{
+		Name: "Compound interest",
+		Code: `package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// Change these to try other loans or savings plans.
+const (
+	principal = 10000.00
+	annual    = 0.0525 // 5.25% a year, compounded monthly
+	years     = 30
+)
+
+func main() {
+	// A bank credits interest in whole cents every month, so each
+	// month's balance feeds the next. In binary floating point neither
+	// the rate nor the balance is exact, and the error compounds along
+	// with the interest. decimal128 holds every cent exactly and
+	// Quantize128 rounds the interest to cents half-even.
+	balance := decimal128(principal)
+	monthly := decimal128(annual) / 12
+	cent := decimal128(0.01)
+
+	fb := float64(principal)
+	fr := annual / 12
+
+	fmt.Println("year  decimal128          float64")
+	for m := 1; m <= years*12; m++ {
+		balance += math.Quantize128(balance*monthly, cent)
+		fb += math.Round(fb*fr*100) / 100
+		if m%60 == 0 {
+			fmt.Printf("%4d  %-18s  %v\n", m/12, fmt.Sprintf("%#g", balance), fb)
+		}
+	}
+}
+`,
+	},
+	{
+		Name: "Quantum validation suite",
+		Code: quantumValidateSrc,
+	},
 }
 
 const indexHTML = `<!DOCTYPE html>
-<html lang="en">
+<html lang="en" class="%s">
 <head>
 <meta charset="utf-8">
 <meta name="viewport" content="width=device-width, initial-scale=1">
 <title>decimal64 playground</title>
+<script>
+// Apply a saved theme before first paint so the page doesn't flash
+// the server default. Embedded pages keep the server's theme.
+(function() {
+  if (%t) return;
+  const theme = localStorage.getItem('decimal64-playground-theme');
+  if (theme === 'light' || theme === 'dark') document.documentElement.className = theme;
+})();
+</script>
 <style>
 * { margin: 0; padding: 0; box-sizing: border-box; }
 :root {
@@ -309,6 +1914,19 @@ const indexHTML = `<!DOCTYPE html>
   --border: #45475a;
   --header: #11111b;
 }
+:root.light {
+  --bg: #eff1f5;
+  --surface: #e6e9ef;
+  --surface2: #ccd0da;
+  --text: #4c4f69;
+  --subtext: #6c6f85;
+  --green: #40a02b;
+  --green-hover: #4cb336;
+  --red: #d20f39;
+  --blue: #1e66f5;
+  --border: #bcc0cc;
+  --header: #dce0e8;
+}
 body {
   font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Roboto, sans-serif;
   background: var(--bg);
@@ -349,6 +1967,17 @@ header h1 span {
   color: var(--header);
 }
 .btn-run:hover { background: var(--green-hover); }
+.btn-vet {
+  background: var(--surface2);
+  color: var(--text);
+  border: 1px solid var(--border);
+}
+.btn-vet:hover { border-color: var(--subtext); }
+.btn-vet:disabled {
+  opacity: 0.5;
+  cursor: not-allowed;
+}
+.btn[hidden] { display: none; }
 .btn-run:disabled {
   opacity: 0.5;
   cursor: not-allowed;
@@ -370,6 +1999,9 @@ header h1 span {
   margin-left: -8px;
 }
 .spacer { flex: 1; }
+.embed header { padding: 6px 12px; gap: 10px; }
+.embed header h1 { font-size: 14px; }
+.embed .tag, .embed .shortcut, .embed #sourcesBtn, .embed #history { display: none; }
 .tag {
   font-size: 12px;
   color: var(--subtext);
@@ -404,6 +2036,34 @@ textarea {
   -moz-tab-size: 4;
 }
 textarea::placeholder { color: var(--subtext); }
+.sources-pane {
+  position: fixed;
+  right: 0;
+  bottom: 0;
+  width: min(640px, 50vw);
+  overflow: auto;
+  background: var(--surface);
+  border-left: 2px solid var(--border);
+  z-index: 10;
+}
+.sources-pane[hidden] { display: none; }
+.sources-pane summary {
+  padding: 8px 20px;
+  cursor: pointer;
+  color: var(--text);
+  background: var(--header);
+  border-bottom: 1px solid var(--border);
+}
+.sources-pane pre {
+  margin: 0;
+  padding: 12px 20px;
+  font-family: "SF Mono", "Fira Code", "Consolas", "Liberation Mono", monospace;
+  font-size: 13px;
+  line-height: 1.5;
+  tab-size: 4;
+  color: var(--text);
+  white-space: pre;
+}
 .output-pane {
   border-top: 2px solid var(--border);
   min-height: 120px;
@@ -435,6 +2095,32 @@ textarea::placeholder { color: var(--subtext); }
 }
 .output-content.error { color: var(--red); }
 .output-content.success { color: var(--text); }
+.dump {
+  border-left: 2px solid var(--blue);
+  padding-left: 8px;
+  margin: 2px 0;
+}
+.dump-encoding {
+  color: var(--subtext);
+  font-size: 12px;
+}
+table.deltas {
+  border-collapse: collapse;
+  margin: 4px 0;
+}
+.deltas th, .deltas td {
+  text-align: left;
+  padding: 2px 12px 2px 0;
+  white-space: nowrap;
+}
+.deltas th { color: var(--subtext); font-weight: 600; }
+.deltas .delta-nonzero td:last-child { color: var(--red); }
+.output-notice {
+  display: block;
+  margin-top: 8px;
+  color: var(--subtext);
+  font-style: italic;
+}
 .spinner {
   display: inline-block;
   width: 14px;
@@ -449,15 +2135,28 @@ textarea::placeholder { color: var(--subtext); }
 @keyframes spin { to { transform: rotate(360deg); } }
 </style>
 </head>
-<body>
+<body class="%s">
 <header>
   <h1><span>decimal64</span> playground</h1>
-  <select id="examples" class="examples-select" onchange="loadExample()">
-  </select>
+  %s
   <div class="spacer"></div>
+  <select id="mode" class="examples-select" title="How to process the program before running it">
+    <option value="">Run as written</option>
+    <option value="autoimport">Add missing imports</option>
+    <option value="deltas">Show float64 deltas</option>
+    <option value="race">Detect data races</option>
+  </select>
+  <label class="shortcut" title="gofmt the program before each run"><input type="checkbox" id="formatOnRun"> format on run</label>
   <span class="shortcut">Ctrl+Enter</span>
+  <select id="history" class="examples-select" onchange="loadHistory()" title="Code from your recent runs of this snippet">
+    <option value="">History&hellip;</option>
+  </select>
+  <button class="btn btn-vet" id="sourcesBtn" onclick="toggleSources()" title="Show the source of every example (Esc to close)">Sources</button>
+  <button class="btn btn-vet" id="vetBtn" onclick="vetCode()">Vet</button>
   <button class="btn btn-run" id="runBtn" onclick="runCode()">Run</button>
+  <button class="btn btn-vet" id="stopBtn" onclick="stopRun()" title="Stop the running program" hidden>Stop</button>
   <span class="tag">go1.26 + decimal64/decimal128</span>
+  <button class="btn btn-vet" id="themeBtn" onclick="toggleTheme()" title="Toggle light/dark theme">&#9680;</button>
 </header>
 <main>
   <div class="editor-pane">
@@ -468,14 +2167,34 @@ textarea::placeholder { color: var(--subtext); }
     <div class="output-content" id="output">Click "Run" or press Ctrl+Enter to execute.</div>
   </div>
 </main>
+<aside class="sources-pane" id="sources" hidden></aside>
 <script>
 const codeEl = document.getElementById('code');
 const outputEl = document.getElementById('output');
 const runBtn = document.getElementById('runBtn');
-const examplesEl = document.getElementById('examples');
+const stopBtn = document.getElementById('stopBtn');
+
+// runController aborts the run in flight, if any. Closing the request
+// cancels its context on the server, which kills the program.
+let runController = null;
+
+function stopRun() {
+  if (runController) runController.abort();
+}
+const vetBtn = document.getElementById('vetBtn');
+// Embedded pages have no examples menu; a detached select keeps the
+// example-handling code below working unchanged.
+const examplesEl = document.getElementById('examples') || document.createElement('select');
 const STORAGE_KEY = 'decimal64-playground-code';
 
 const examples = %s;
+const preload = %s;
+const embed = %t;
+
+// Embedded pages read nothing from and write nothing to localStorage.
+const storage = embed
+  ? {getItem: function() { return null; }, setItem: function() {}, removeItem: function() {}}
+  : localStorage;
 
 // Populate examples dropdown.
 const placeholder = document.createElement('option');
@@ -490,29 +2209,225 @@ examples.forEach(function(ex, i) {
   examplesEl.appendChild(opt);
 });
 
-// Restore from localStorage, or fall back to first example.
-const saved = localStorage.getItem(STORAGE_KEY);
-if (saved !== null) {
+const THEME_KEY = 'decimal64-playground-theme';
+const MODE_KEY = 'decimal64-playground-mode';
+const FORMAT_KEY = 'decimal64-playground-format-on-run';
+
+const modeEl = document.getElementById('mode');
+modeEl.value = storage.getItem(MODE_KEY) || '';
+if (modeEl.selectedIndex < 0) modeEl.value = '';
+modeEl.addEventListener('change', function() {
+  storage.setItem(MODE_KEY, this.value);
+});
+
+const formatEl = document.getElementById('formatOnRun');
+formatEl.checked = storage.getItem(FORMAT_KEY) === '1';
+formatEl.addEventListener('change', function() {
+  storage.setItem(FORMAT_KEY, this.checked ? '1' : '0');
+});
+
+// Replace the editor content with its gofmt form. Failures, such as
+// syntax errors, leave the code alone so the run reports them.
+async function formatCode(signal) {
+  try {
+    const resp = await fetch('/api/format', {
+      method: 'POST',
+      headers: {'Content-Type': 'application/json'},
+      body: JSON.stringify({code: codeEl.value}),
+      signal: signal,
+    });
+    const data = await resp.json();
+    if (data.code && data.code !== codeEl.value) {
+      const pos = codeEl.selectionStart;
+      codeEl.value = data.code;
+      codeEl.selectionStart = codeEl.selectionEnd = Math.min(pos, data.code.length);
+      storage.setItem(STORAGE_KEY, codeEl.value);
+    }
+  } catch (err) {
+    if (err.name === 'AbortError') throw err;
+  }
+}
+
+function toggleTheme() {
+  const root = document.documentElement;
+  const theme = root.className === 'light' ? 'dark' : 'light';
+  root.className = theme;
+  storage.setItem(THEME_KEY, theme);
+}
+
+// The editor's scroll position and selection are saved per snippet:
+// an example is identified by its name, the restored buffer by the
+// snippet it was last loaded from.
+const SNIPPET_KEY = 'decimal64-playground-snippet';
+const VIEW_KEY_PREFIX = 'decimal64-playground-view:';
+let snippetId;
+
+function saveView() {
+  storage.setItem(VIEW_KEY_PREFIX + snippetId, JSON.stringify({
+    scrollTop: codeEl.scrollTop,
+    start: codeEl.selectionStart,
+    end: codeEl.selectionEnd,
+  }));
+}
+
+// Restore the saved view for the current snippet, or put the cursor
+// at the top if there is none.
+function restoreView() {
+  let view = null;
+  try {
+    view = JSON.parse(storage.getItem(VIEW_KEY_PREFIX + snippetId));
+  } catch (e) {}
+  const len = codeEl.value.length;
+  if (view) {
+    codeEl.setSelectionRange(Math.min(view.start, len), Math.min(view.end, len));
+    codeEl.scrollTop = view.scrollTop;
+  } else {
+    codeEl.setSelectionRange(0, 0);
+    codeEl.scrollTop = 0;
+  }
+}
+
+// Each snippet keeps the code from its last HISTORY_MAX runs, newest
+// first, so a user who breaks it can go back to a version that worked.
+const HISTORY_KEY_PREFIX = 'decimal64-playground-history:';
+const HISTORY_MAX = 20;
+const historyEl = document.getElementById('history');
+
+function readHistory() {
+  try {
+    return JSON.parse(storage.getItem(HISTORY_KEY_PREFIX + snippetId)) || [];
+  } catch (e) {
+    return [];
+  }
+}
+
+function recordHistory(code) {
+  const history = readHistory();
+  if (history.length > 0 && history[0].code === code) return;
+  history.unshift({code: code, time: Date.now()});
+  storage.setItem(HISTORY_KEY_PREFIX + snippetId, JSON.stringify(history.slice(0, HISTORY_MAX)));
+  refreshHistory();
+}
+
+function refreshHistory() {
+  historyEl.length = 1; // keep "History…"
+  readHistory().forEach(function(entry, i) {
+    const opt = document.createElement('option');
+    opt.value = String(i);
+    opt.textContent = new Date(entry.time).toLocaleString() + ' \u2014 ' +
+      entry.code.split('\n').length + ' lines';
+    historyEl.appendChild(opt);
+  });
+  historyEl.selectedIndex = 0;
+}
+
+function loadHistory() {
+  const entry = readHistory()[historyEl.value];
+  historyEl.selectedIndex = 0;
+  if (!entry) return;
+  codeEl.value = entry.code;
+  storage.setItem(STORAGE_KEY, codeEl.value);
+  storage.setItem(SNIPPET_KEY, snippetId);
+  codeEl.focus({preventScroll: true});
+}
+
+// Use server-provided code (e.g. from ?gist=), else restore from
+// localStorage, else fall back to the first example.
+const saved = storage.getItem(STORAGE_KEY);
+if (preload !== null) {
+  codeEl.value = preload.code;
+  examplesEl.selectedIndex = 0; // "Examples…"
+  snippetId = 'preload';
+  storage.removeItem(VIEW_KEY_PREFIX + snippetId);
+  if (preload.notice) {
+    outputEl.className = 'output-content error';
+    outputEl.textContent = preload.notice;
+  }
+} else if (saved !== null) {
   codeEl.value = saved;
   examplesEl.selectedIndex = 0; // "Examples…"
+  snippetId = storage.getItem(SNIPPET_KEY) || 'saved';
 } else {
   codeEl.value = examples[0].code;
   examplesEl.value = '0';
+  snippetId = 'example:' + examples[0].name;
 }
-codeEl.focus();
+codeEl.focus({preventScroll: true});
+restoreView();
+refreshHistory();
 
 function loadExample() {
   const idx = examplesEl.value;
   if (idx === '') return;
+  snippetId = 'example:' + examples[idx].name;
   codeEl.value = examples[idx].code;
-  codeEl.selectionStart = codeEl.selectionEnd = 0;
-  codeEl.focus();
-  localStorage.setItem(STORAGE_KEY, codeEl.value);
+  codeEl.focus({preventScroll: true});
+  restoreView();
+  refreshHistory();
+  storage.setItem(STORAGE_KEY, codeEl.value);
+  storage.setItem(SNIPPET_KEY, snippetId);
+}
+
+// Load the example delta steps away from the current selection,
+// wrapping around at either end.
+function stepExample(delta) {
+  const n = examples.length;
+  const idx = examplesEl.value === '' ? (delta > 0 ? -1 : 0) : Number(examplesEl.value);
+  examplesEl.value = String((idx + delta + n) %% n);
+  loadExample();
+}
+
+// Alt+Left/Alt+Right cycle through the examples. Text fields, the
+// editor included, and selects keep their own arrow-key behavior, since
+// Option+Left/Right is word navigation on macOS and loading an example
+// would replace unrun edits.
+document.addEventListener('keydown', function(e) {
+  if (embed) return;
+  if (!e.altKey || e.ctrlKey || e.metaKey || e.shiftKey) return;
+  if (e.key !== 'ArrowLeft' && e.key !== 'ArrowRight') return;
+  const el = document.activeElement;
+  if (el && (el.tagName === 'INPUT' || el.tagName === 'SELECT' ||
+             el.tagName === 'TEXTAREA' || el.isContentEditable)) return;
+  e.preventDefault();
+  stepExample(e.key === 'ArrowRight' ? 1 : -1);
+});
+
+// The sources pane lists every example read-only, so a presenter can
+// refer to one without replacing the editor buffer. It is built from
+// examples on first open.
+const sourcesEl = document.getElementById('sources');
+
+function toggleSources() {
+  if (!sourcesEl.firstChild) {
+    examples.forEach(function(ex) {
+      const details = document.createElement('details');
+      const summary = document.createElement('summary');
+      summary.textContent = ex.name;
+      const pre = document.createElement('pre');
+      pre.textContent = ex.code;
+      details.appendChild(summary);
+      details.appendChild(pre);
+      sourcesEl.appendChild(details);
+    });
+  }
+  sourcesEl.style.top = document.querySelector('header').offsetHeight + 'px';
+  sourcesEl.hidden = !sourcesEl.hidden;
 }
 
+document.addEventListener('keydown', function(e) {
+  if (e.key === 'Escape' && !sourcesEl.hidden) {
+    sourcesEl.hidden = true;
+  }
+});
+
 // Save to localStorage on every edit.
 codeEl.addEventListener('input', function() {
-  localStorage.setItem(STORAGE_KEY, codeEl.value);
+  storage.setItem(STORAGE_KEY, codeEl.value);
+  storage.setItem(SNIPPET_KEY, snippetId);
+});
+
+['input', 'scroll', 'select', 'keyup', 'mouseup'].forEach(function(ev) {
+  codeEl.addEventListener(ev, saveView);
 });
 
 // Tab key inserts a real tab.
@@ -523,7 +2438,7 @@ codeEl.addEventListener('keydown', function(e) {
     const end = this.selectionEnd;
     this.value = this.value.substring(0, s) + '\t' + this.value.substring(end);
     this.selectionStart = this.selectionEnd = s + 1;
-    localStorage.setItem(STORAGE_KEY, this.value);
+    storage.setItem(STORAGE_KEY, this.value);
   }
   if ((e.ctrlKey || e.metaKey) && e.key === 'Enter') {
     e.preventDefault();
@@ -531,34 +2446,168 @@ codeEl.addEventListener('keydown', function(e) {
   }
 });
 
+// Select the given 1-based line in the editor and scroll it into view.
+function highlightLine(line) {
+  const lines = codeEl.value.split('\n');
+  if (line < 1 || line > lines.length) return;
+  let start = 0;
+  for (let i = 0; i < line - 1; i++) start += lines[i].length + 1;
+  codeEl.focus();
+  codeEl.setSelectionRange(start, start + lines[line - 1].length);
+  const lineHeight = parseFloat(getComputedStyle(codeEl).lineHeight);
+  codeEl.scrollTop = Math.max(0, (line - 3) * lineHeight);
+}
+
+async function vetCode() {
+  vetBtn.disabled = true;
+  outputEl.className = 'output-content';
+  outputEl.textContent = 'Vetting...';
+
+  try {
+    const resp = await fetch('/api/vet', {
+      method: 'POST',
+      headers: {'Content-Type': 'application/json'},
+      body: JSON.stringify({code: codeEl.value}),
+    });
+    const data = await resp.json();
+
+    if (data.error) {
+      outputEl.className = 'output-content error';
+      outputEl.textContent = data.output ? data.output + '\n' + data.error : data.error;
+    } else if (data.diagnostics && data.diagnostics.length > 0) {
+      outputEl.className = 'output-content error';
+      outputEl.textContent = data.output;
+      highlightLine(data.diagnostics[0].line);
+    } else {
+      outputEl.className = 'output-content success';
+      outputEl.textContent = 'No issues found.';
+    }
+  } catch (err) {
+    outputEl.className = 'output-content error';
+    outputEl.textContent = 'Request failed: ' + err.message;
+  } finally {
+    vetBtn.disabled = false;
+  }
+}
+
+// Show program output, rendering decimal.Dump lines (marked with
+// U+001E) as the value with its BID encoding beneath, and runs of
+// delta lines from the "deltas" mode as a table.
+function renderOutput(text) {
+  outputEl.textContent = '';
+  let plain = '';
+  let table = null;
+  text.split('\n').forEach(function(line, i, lines) {
+    let dump = null;
+    if (line.charAt(0) === '\x1e') {
+      try { dump = JSON.parse(line.slice(1)); } catch (e) {}
+    }
+    if (!dump) {
+      plain += line + (i < lines.length - 1 ? '\n' : '');
+      return;
+    }
+    if (plain) table = null;
+    outputEl.appendChild(document.createTextNode(plain));
+    plain = '';
+    if (dump.delta) {
+      if (!table) {
+        table = document.createElement('table');
+        table.className = 'deltas';
+        addRow(table, 'th', ['line', 'expression', 'decimal', 'float64', 'float64 \u2212 decimal']);
+        outputEl.appendChild(table);
+      }
+      const row = addRow(table, 'td', [dump.line, dump.expr, dump.decimal, dump.float, dump.diff === null ? '?' : dump.diff]);
+      if (dump.diff !== null && !/^-?0(e[-+]?\d+)?$/.test(dump.diff)) row.className = 'delta-nonzero';
+      return;
+    }
+    table = null;
+    const el = document.createElement('div');
+    el.className = 'dump';
+    const value = document.createElement('div');
+    value.textContent = dump.value;
+    const enc = document.createElement('div');
+    enc.className = 'dump-encoding';
+    enc.textContent = dump.coeff === null
+      ? 'special value, bits ' + dump.bits
+      : 'coefficient ' + dump.coeff + ' \u00d7 10^' + dump.exp + ', bits ' + dump.bits;
+    el.appendChild(value);
+    el.appendChild(enc);
+    outputEl.appendChild(el);
+  });
+  outputEl.appendChild(document.createTextNode(plain));
+}
+
+function addRow(table, tag, cells) {
+  const row = table.insertRow();
+  cells.forEach(function(text) {
+    const cell = document.createElement(tag);
+    cell.textContent = text;
+    row.appendChild(cell);
+  });
+  return row;
+}
+
 async function runCode() {
+  if (runController) return;
+  runController = new AbortController();
   runBtn.disabled = true;
   runBtn.innerHTML = '<span class="spinner"></span>Running';
+  stopBtn.hidden = false;
   outputEl.className = 'output-content';
   outputEl.textContent = 'Compiling and running...';
 
   try {
+    if (formatEl.checked) await formatCode(runController.signal);
+    recordHistory(codeEl.value);
     const resp = await fetch('/api/run', {
       method: 'POST',
       headers: {'Content-Type': 'application/json'},
-      body: JSON.stringify({code: codeEl.value}),
+      body: JSON.stringify({code: codeEl.value, mode: modeEl.value}),
+      signal: runController.signal,
     });
     const data = await resp.json();
 
     if (data.error) {
       outputEl.className = 'output-content error';
-      outputEl.textContent = data.output ? data.output + '\n' + data.error : data.error;
+      renderOutput(data.output ? data.output + '\n' + data.error : data.error);
+      if (data.diagnostics && data.diagnostics.length > 0) {
+        highlightLine(data.diagnostics[0].line);
+      }
     } else {
       outputEl.className = 'output-content success';
-      outputEl.textContent = data.output || '(no output)';
+      renderOutput(data.output || '(no output)');
+    }
+    if (data.notice) {
+      const notice = document.createElement('span');
+      notice.className = 'output-notice';
+      notice.textContent = data.notice;
+      outputEl.insertBefore(notice, outputEl.firstChild);
+    }
+    const timing = document.createElement('span');
+    timing.className = 'output-notice';
+    timing.textContent = data.execMs || !data.error
+      ? 'compiled in ' + data.compileMs + 'ms, ran in ' + data.execMs + 'ms'
+      : 'compile took ' + data.compileMs + 'ms';
+    if (data.maxRssKb) {
+      timing.textContent += ' (' + (data.userMs || 0) + 'ms user, ' + (data.sysMs || 0) + 'ms sys, ' +
+        (data.maxRssKb / 1024).toFixed(1) + ' MiB peak memory)';
+    }
+    outputEl.appendChild(timing);
+    if (data.truncated) {
+      const notice = document.createElement('span');
+      notice.className = 'output-notice';
+      notice.textContent = '(output truncated, ' + data.omitted + ' bytes omitted)';
+      outputEl.appendChild(notice);
     }
   } catch (err) {
     outputEl.className = 'output-content error';
-    outputEl.textContent = 'Request failed: ' + err.message;
+    outputEl.textContent = err.name === 'AbortError' ? 'Stopped.' : 'Request failed: ' + err.message;
   } finally {
+    runController = null;
+    stopBtn.hidden = true;
     runBtn.disabled = false;
     runBtn.textContent = 'Run';
-    codeEl.focus();
+    codeEl.focus({preventScroll: true});
   }
 }
 </script>
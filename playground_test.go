@@ -0,0 +1,1471 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParseDiagnostics(t *testing.T) {
+	tests := []struct {
+		name string
+		out  string
+		want []diagnostic
+	}{
+		{"empty", "", nil},
+		{"no positions", "# command-line-arguments\nexit status 2\n", nil},
+		{
+			"compile errors",
+			"# command-line-arguments\nprog.go:3:2: undefined: x\nprog.go:10:15: missing return\n",
+			[]diagnostic{{3, 2, "undefined: x"}, {10, 15, "missing return"}},
+		},
+		{
+			"message with colons",
+			"prog.go:7:9: cannot use d (variable of type decimal64) as float64 value in argument to f: mismatched\n",
+			[]diagnostic{{7, 9, "cannot use d (variable of type decimal64) as float64 value in argument to f: mismatched"}},
+		},
+		{
+			"other files ignored",
+			"helper.go:1:1: unused\n\tprog.go:4:4: indented\nprog.go:5:1: kept\n",
+			[]diagnostic{{5, 1, "kept"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseDiagnostics(tt.out); !slices.Equal(got, tt.want) {
+				t.Errorf("parseDiagnostics(%q) = %v, want %v", tt.out, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLimitedBuffer(t *testing.T) {
+	tests := []struct {
+		name        string
+		limit       int
+		writes      []string
+		want        string
+		wantOmitted int64
+	}{
+		{"under limit", 10, []string{"abc", "de"}, "abcde", 0},
+		{"exactly at limit", 5, []string{"abc", "de"}, "abcde", 0},
+		{"split write", 4, []string{"abc", "def"}, "abcd", 2},
+		{"writes after full", 3, []string{"abc", "de", "f"}, "abc", 3},
+		{"zero limit", 0, []string{"abc"}, "", 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &limitedBuffer{limit: tt.limit}
+			for _, w := range tt.writes {
+				// Writes report full success so the program's
+				// output pipes never see an error.
+				if n, err := b.Write([]byte(w)); n != len(w) || err != nil {
+					t.Fatalf("Write(%q) = %d, %v; want %d, nil", w, n, err, len(w))
+				}
+			}
+			if got := string(b.buf); got != tt.want || b.omitted != tt.wantOmitted {
+				t.Errorf("buf = %q, omitted = %d; want %q, %d", got, b.omitted, tt.want, tt.wantOmitted)
+			}
+		})
+	}
+}
+
+func TestStripBuildConstraints(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"none", "package main\n", "package main\n"},
+		{"go:build", "//go:build ignore\n\npackage main\n", "\n\npackage main\n"},
+		{
+			"both forms",
+			"//go:build linux\n// +build linux\n\npackage main\n",
+			"\n\n\npackage main\n",
+		},
+		{
+			"comments kept",
+			"// Copyright.\n//go:build ignore\npackage main\n",
+			"// Copyright.\n\npackage main\n",
+		},
+		{
+			"after package untouched",
+			"package main\n\n//go:build ignore\n",
+			"package main\n\n//go:build ignore\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stripBuildConstraints(tt.src); got != tt.want {
+				t.Errorf("stripBuildConstraints(%q) = %q, want %q", tt.src, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleRunBatchRejects(t *testing.T) {
+	tooMany := `{"snippets":[` + strings.Repeat(`{"code":""},`, maxBatch) + `{"code":""}]}`
+	tests := []struct {
+		name   string
+		method string
+		body   string
+		want   int
+	}{
+		{"GET", http.MethodGet, "", http.StatusMethodNotAllowed},
+		{"bad JSON", http.MethodPost, "{", http.StatusBadRequest},
+		{"too many snippets", http.MethodPost, tooMany, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handleRunBatch(rec, httptest.NewRequest(tt.method, "/api/run-batch", strings.NewReader(tt.body)))
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+// TestHandleRunBatch builds and runs real programs with the toolchain
+// in GOROOT. They don't use decimals, so a stock toolchain will do.
+func TestHandleRunBatch(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds programs")
+	}
+	body := `{"snippets":[
+		{"name":"fails","code":"package main\nfunc main() { undefined() }"},
+		{"name":"prints","code":"package main\nimport \"fmt\"\nfunc main() { fmt.Println(\"hi\") }"}
+	]}`
+	rec := httptest.NewRecorder()
+	handleRunBatch(rec, httptest.NewRequest(http.MethodPost, "/api/run-batch", strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	var results []batchResult
+	if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want 2", len(results))
+	}
+	if r := results[0]; r.Name != "fails" || r.Error == "" || len(r.Diagnostics) != 1 || r.Diagnostics[0].Line != 2 {
+		t.Errorf("results[0] = %+v, want a compile error at line 2", r)
+	}
+	if r := results[1]; r.Name != "prints" || r.Error != "" || r.Output != "hi\n" {
+		t.Errorf("results[1] = %+v, want output \"hi\\n\"", r)
+	}
+	// A successful run times both phases; a build can't take under a
+	// millisecond, while a trivial program can.
+	if r := results[1]; r.CompileMS <= 0 || r.ExecMS < 0 {
+		t.Errorf("results[1] took compileMs %d, execMs %d; want > 0 and >= 0", r.CompileMS, r.ExecMS)
+	}
+}
+
+func TestCollapseCR(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"no CR", "a\nb\n", "a\nb\n"},
+		{"progress", "10%\r50%\r100%\ndone\n", "100%\ndone\n"},
+		{"longer tail kept", "loading...\rok\n", "okading...\n"},
+		{"trailing CR", "abc\r\n", "abc\n"},
+		{"multibyte", "ééé\rx\n", "xéé\n"},
+		{"only affected lines", "a\rb\nc\n", "b\nc\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := collapseCR(tt.in); got != tt.want {
+				t.Errorf("collapseCR(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadExamples(t *testing.T) {
+	builtin := examples
+	t.Cleanup(func() { examples = builtin })
+
+	tests := []struct {
+		name     string
+		contents string // "" means the file doesn't exist
+		append   bool
+		want     []string
+	}{
+		{"missing file", "", false, []string{"builtin"}},
+		{"bad JSON", "[", false, []string{"builtin"}},
+		{"no examples", "[]", false, []string{"builtin"}},
+		{"missing code", `[{"name":"a","code":"x"},{"name":"b"}]`, false, []string{"builtin"}},
+		{"replace", `[{"name":"a","code":"x"},{"name":"b","code":"y"}]`, false, []string{"a", "b"}},
+		{"append", `[{"name":"a","code":"x"}]`, true, []string{"builtin", "a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			examples = []example{{Name: "builtin", Code: "package main"}}
+			path := filepath.Join(t.TempDir(), "examples.json")
+			if tt.contents != "" {
+				if err := os.WriteFile(path, []byte(tt.contents), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			loadExamples(path, tt.append)
+			var got []string
+			for _, ex := range examples {
+				got = append(got, ex.Name)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("examples = %v, want %v", got, tt.want)
+			}
+
+			// The page fills its examples menu from the examples it
+			// is served.
+			rec := httptest.NewRecorder()
+			handleIndex(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+			page := rec.Body.String()
+			if !strings.Contains(page, `<select id="examples"`) {
+				t.Error("page has no examples menu")
+			}
+			if served := pageExampleNames(t, page); !slices.Equal(served, tt.want) {
+				t.Errorf("page serves examples %v, want %v", served, tt.want)
+			}
+		})
+	}
+}
+
+// pageExampleNames returns the names of the examples a rendered page
+// passes to its script.
+func pageExampleNames(t *testing.T, page string) []string {
+	t.Helper()
+	const marker = "const examples = "
+	i := strings.Index(page, marker)
+	if i < 0 {
+		t.Fatal("page has no examples")
+	}
+	line, _, _ := strings.Cut(page[i+len(marker):], "\n")
+	var exs []example
+	if err := json.Unmarshal([]byte(strings.TrimSuffix(line, ";")), &exs); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, ex := range exs {
+		names = append(names, ex.Name)
+	}
+	return names
+}
+
+// TestRunProgramDeadlock builds and runs real programs with the
+// toolchain in GOROOT; see TestHandleRunBatch.
+func TestRunProgramDeadlock(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds programs")
+	}
+	const deadlocked = "program deadlocked: all goroutines are blocked"
+	tests := []struct {
+		name string
+		code string
+		want string
+	}{
+		{"empty select", "package main\nfunc main() { select {} }", deadlocked},
+		{"unbuffered send", "package main\nfunc main() { make(chan int) <- 1 }", deadlocked},
+		{
+			"blocked with goroutines",
+			"package main\nimport \"sync\"\nfunc main() { var wg sync.WaitGroup; wg.Add(2); go wg.Done(); wg.Wait() }",
+			deadlocked,
+		},
+		{"panic", "package main\nfunc main() { panic(\"boom\") }", "exit status 2"},
+		{"clean exit", "package main\nfunc main() {}", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := runProgram(context.Background(), runRequest{Code: tt.code})
+			if resp.Error != tt.want {
+				t.Errorf("Error = %q, want %q; output:\n%s", resp.Error, tt.want, resp.Output)
+			}
+		})
+	}
+}
+
+func TestAutoImport(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"nothing used", "package main\nfunc main() {}\n", "package main\nfunc main() {}\n"},
+		{
+			"missing",
+			"package main\nfunc main() { fmt.Println(1) }\n",
+			"package main; import \"fmt\"\nfunc main() { fmt.Println(1) }\n",
+		},
+		{
+			"sorted, once each",
+			"package main\nfunc main() { fmt.Println(strings.ToUpper(\"a\"), fmt.Sprint(slog.LevelInfo)) }\n",
+			"package main; import \"fmt\"; import \"log/slog\"; import \"strings\"\nfunc main() { fmt.Println(strings.ToUpper(\"a\"), fmt.Sprint(slog.LevelInfo)) }\n",
+		},
+		{
+			"already imported",
+			"package main\nimport \"fmt\"\nfunc main() { fmt.Println(os.Args) }\n",
+			"package main; import \"os\"\nimport \"fmt\"\nfunc main() { fmt.Println(os.Args) }\n",
+		},
+		{
+			"shadowed by parameter",
+			"package main\nfunc f(bytes struct{ N int }) int { return bytes.N }\n",
+			"package main\nfunc f(bytes struct{ N int }) int { return bytes.N }\n",
+		},
+		{
+			"shadowed by variable",
+			"package main\nfunc main() { strings := struct{ N int }{}; _ = strings.N }\n",
+			"package main\nfunc main() { strings := struct{ N int }{}; _ = strings.N }\n",
+		},
+		{
+			"shadowed by top-level declaration",
+			"package main\nfunc main() { _ = sort.N }\nvar sort struct{ N int }\n",
+			"package main\nfunc main() { _ = sort.N }\nvar sort struct{ N int }\n",
+		},
+		{
+			"struct field of the same name",
+			"package main\ntype clock struct{ time int }\nfunc main() { time.Sleep(1) }\n",
+			"package main; import \"time\"\ntype clock struct{ time int }\nfunc main() { time.Sleep(1) }\n",
+		},
+		{
+			"parameter in another function",
+			"package main\nfunc f(time int) {}\nfunc main() { time.Sleep(1) }\n",
+			"package main; import \"time\"\nfunc f(time int) {}\nfunc main() { time.Sleep(1) }\n",
+		},
+		{"unknown package", "package main\nfunc main() { foo.Bar() }\n", "package main\nfunc main() { foo.Bar() }\n"},
+		{"does not parse", "package main\nfunc main() { fmt.Println( }\n", "package main\nfunc main() { fmt.Println( }\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := autoImport(tt.src)
+			if got != tt.want {
+				t.Errorf("autoImport(%q) =\n%q\nwant\n%q", tt.src, got, tt.want)
+			}
+			if strings.Count(got, "\n") != strings.Count(tt.src, "\n") {
+				t.Errorf("autoImport changed the line count")
+			}
+		})
+	}
+}
+
+func TestSandboxNotice(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string // a substring of the notice, or "" for none
+	}{
+		{"none", "package main\nimport \"fmt\"\nfunc main() { fmt.Println() }", ""},
+		{"read only", "package main\nimport \"os\"\nfunc main() { os.ReadFile(\"x\") }", ""},
+		{"write", "package main\nimport \"os\"\nfunc main() { os.WriteFile(\"x\", nil, 0644) }", "writes to the filesystem"},
+		{"renamed import", "package main\nimport o \"os\"\nfunc main() { o.Create(\"x\") }", "writes to the filesystem"},
+		{"http", "package main\nimport \"net/http\"\nfunc main() { http.Get(\"http://x\") }", "uses the network"},
+		{
+			"both",
+			"package main\nimport (\"net\"; \"os\")\nfunc main() { os.Remove(\"x\"); net.Dial(\"tcp\", \"x\") }",
+			"the filesystem and the network",
+		},
+		{"local os", "package main\ntype T struct{}\nfunc (T) Create() {}\nvar os T\nfunc main() { os.Create() }", ""},
+		{"does not parse", "package main\nimport \"os\"\nfunc main() { os.Create( }", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := sandboxNotice(tt.src)
+			if tt.want == "" && got != "" || !strings.Contains(got, tt.want) {
+				t.Errorf("sandboxNotice = %q, want one containing %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParamType(t *testing.T) {
+	tests := []struct {
+		call string
+		want []int // arguments that go to float64 parameters
+	}{
+		{"math.Sqrt(1)", []int{0}},
+		{"math.Ldexp(0.5, 3)", []int{0}},
+		{"math.Float64frombits(1)", nil},
+		{"sum(1, 2, 3)", []int{0, 1, 2}},
+		{"sum([]float64{1}...)", nil},
+		{"fmt.Sprint(1.5)", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.call, func(t *testing.T) {
+			src := "package p\nimport (\"fmt\"; \"math\")\nfunc sum(xs ...float64) float64 { return 0 }\nvar _ = " + tt.call + "\nvar _ = fmt.Sprint\nvar _ = math.Pi\n"
+			fset := token.NewFileSet()
+			f, err := parser.ParseFile(fset, "p.go", src, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			info := &types.Info{Types: make(map[ast.Expr]types.TypeAndValue)}
+			conf := types.Config{Importer: importer.Default()}
+			if _, err := conf.Check("p", fset, []*ast.File{f}, info); err != nil {
+				t.Fatal(err)
+			}
+			call := f.Decls[2].(*ast.GenDecl).Specs[0].(*ast.ValueSpec).Values[0].(*ast.CallExpr)
+			sig := info.Types[call.Fun].Type.(*types.Signature)
+			var got []int
+			for i := range call.Args {
+				if p := paramType(sig, i, call.Ellipsis.IsValid()); p != nil && types.Identical(p, types.Typ[types.Float64]) {
+					got = append(got, i)
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("float64 arguments = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// needDecimal skips tests that need a toolchain with the decimal
+// types: the stock type checker and standard library know nothing of
+// them.
+func needDecimal(t *testing.T) {
+	t.Helper()
+	if types.Universe.Lookup("decimal64") == nil {
+		t.Skip("toolchain has no decimal64")
+	}
+}
+
+// vetLines returns the lines decimalVet reports in src, and checks that
+// every message contains want.
+func vetLines(t *testing.T, src, want string) []int {
+	t.Helper()
+	var lines []int
+	for _, d := range decimalVet(src) {
+		if !strings.Contains(d.Msg, want) {
+			t.Errorf("line %d: %q, want a message containing %q", d.Line, d.Msg, want)
+		}
+		lines = append(lines, d.Line)
+	}
+	return lines
+}
+
+func TestCheckFloatMathCall(t *testing.T) {
+	needDecimal(t)
+	src := `package main
+
+import "math"
+
+func main() {
+	var d decimal64 = 2
+	_ = math.Sqrt(d)
+	_ = math.Floor(d)
+	_ = math.Quantize64(d, 0.01)
+	_ = math.Floor64(d)
+	_ = math.Float64frombits(math.Decimal64bits(d))
+	_ = math.Ldexp(0.5, 3)
+}
+`
+	if got, want := vetLines(t, src, "takes float64"), []int{7, 8}; !slices.Equal(got, want) {
+		t.Errorf("diagnostics on lines %v, want %v", got, want)
+	}
+}
+
+func TestCheckLossyConversion(t *testing.T) {
+	needDecimal(t)
+	src := `package main
+
+func main() {
+	f := 0.1
+	_ = decimal64(f)
+	_ = decimal64(0.1)
+	const c = 0.25
+	_ = decimal128(c)
+	var g float32 = 1
+	_ = decimal128(g)
+	_ = decimal64(3)
+	_ = float64(decimal64(1))
+}
+`
+	if got, want := vetLines(t, src, "may be inexact"), []int{5, 10}; !slices.Equal(got, want) {
+		t.Errorf("diagnostics on lines %v, want %v", got, want)
+	}
+}
+
+func TestCheckDecimalRemainder(t *testing.T) {
+	needDecimal(t)
+	src := `package main
+
+func main() {
+	var d decimal64 = 7
+	var e decimal128 = 7
+	n := 7
+	_ = d % 2
+	e %= 3
+	_ = n % 2
+	n %= 3
+	_ = d / 2
+}
+`
+	if got, want := vetLines(t, src, "operator % is not defined"), []int{7, 8}; !slices.Equal(got, want) {
+		t.Errorf("diagnostics on lines %v, want %v", got, want)
+	}
+	if d := decimalVet(src); len(d) == 2 && !strings.Contains(d[1].Msg, "math.Trunc128") {
+		t.Errorf("decimal128 remainder: %q, want a message suggesting math.Trunc128", d[1].Msg)
+	}
+}
+
+func TestCheckMixedArithmetic(t *testing.T) {
+	needDecimal(t)
+	src := `package main
+
+func main() {
+	var d decimal64 = 1
+	f := 0.5
+	_ = d * f
+	_ = f + d
+	_ = d * 0.5
+	_ = f * f
+	_ = d + d
+	_ = d * decimal64(2)
+}
+`
+	if got, want := vetLines(t, src, "mixed decimal64 and float64 operands"), []int{6, 7}; !slices.Equal(got, want) {
+		t.Errorf("diagnostics on lines %v, want %v", got, want)
+	}
+}
+
+// TestHandleVet checks how handleVet merges decimalVet's findings with
+// go vet's, using a stand-in check the stock type checker can run. It
+// runs go vet with the toolchain in GOROOT; see TestHandleRunBatch.
+func TestHandleVet(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds programs")
+	}
+	saved := decimalChecks
+	decimalChecks = []decimalCheck{func(info *types.Info, n ast.Node, report func(ast.Node, string)) {
+		if lit, ok := n.(*ast.BasicLit); ok && lit.Value == "7" {
+			report(lit, "seven")
+		}
+	}}
+	t.Cleanup(func() { decimalChecks = saved })
+
+	code := "package main\n\nimport \"fmt\"\n\nfunc main() {\n\tx := 7\n\tfmt.Printf(\"%d\\n\", \"s\")\n\t_ = x + 7\n}\n"
+	body, _ := json.Marshal(runRequest{Code: code})
+	rec := httptest.NewRecorder()
+	handleVet(rec, httptest.NewRequest(http.MethodPost, "/api/vet", strings.NewReader(string(body))))
+	if !strings.Contains(rec.Body.String(), `{"line":6,"col":7,"msg":"seven"}`) {
+		t.Errorf("body %s doesn't hold the diagnostic as {line, col, msg}", rec.Body)
+	}
+	var resp runResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("%v: %s", err, rec.Body)
+	}
+	var got []string
+	for _, d := range resp.Diagnostics {
+		got = append(got, fmt.Sprintf("%d:%d", d.Line, d.Col))
+	}
+	// go vet's printf finding sits between the two stand-in findings.
+	if want := []string{"6:7", "7:14", "8:10"}; !slices.Equal(got, want) || !strings.Contains(resp.Diagnostics[1].Msg, "wrong type") {
+		t.Errorf("diagnostics %+v, want positions %v with go vet's printf report second", resp.Diagnostics, want)
+	}
+	for _, line := range []string{"prog.go:6:7: seven\n", "prog.go:8:10: seven\n"} {
+		if !strings.Contains(resp.Output, line) {
+			t.Errorf("output doesn't contain %q:\n%s", line, resp.Output)
+		}
+	}
+}
+
+func TestCheckGODEBUG(t *testing.T) {
+	tests := []struct {
+		in string
+		ok bool
+	}{
+		{"gctrace=1", true},
+		{"gctrace=1,schedtrace=1000", true},
+		{"panicnil=1,asyncpreemptoff=1", true},
+		{"madvdontneed=1", false},
+		{"gctrace", false},
+		{"gctrace=", false},
+		{"gctrace=1,", false},
+		{"gctrace=1 ", false},
+		{"gctrace=ON", false},
+		{"gctrace=12345678901234567", false},
+		{"gctrace=1,cpu.all=off", false},
+	}
+	for _, tt := range tests {
+		if err := checkGODEBUG(tt.in); (err == nil) != tt.ok {
+			t.Errorf("checkGODEBUG(%q) = %v, want ok = %t", tt.in, err, tt.ok)
+		}
+	}
+}
+
+// TestRunProgramRejectsBeforeSlot fills every run slot, so a request
+// only gets an answer if it is refused without waiting for one.
+func TestRunProgramRejectsBeforeSlot(t *testing.T) {
+	for range cap(runSlots) {
+		runSlots <- struct{}{}
+	}
+	t.Cleanup(func() {
+		for range cap(runSlots) {
+			<-runSlots
+		}
+	})
+
+	const code = "package main\nfunc main() {}"
+	tests := []struct {
+		name string
+		req  runRequest
+		want string
+	}{
+		{"GODEBUG", runRequest{Code: code, GODEBUG: "madvdontneed=1"}, "GODEBUG setting"},
+		{"mode", runRequest{Code: code, Mode: "turbo"}, `unknown mode "turbo"`},
+		{"import", runRequest{Code: "package main\nimport \"unsafe\"\nfunc main() {}"}, `import "unsafe" is not allowed`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			if resp := runProgram(ctx, tt.req); !strings.Contains(resp.Error, tt.want) {
+				t.Errorf("Error = %q, want one containing %q", resp.Error, tt.want)
+			}
+		})
+	}
+}
+
+// TestRunProgramGODEBUG checks that an allowed GODEBUG setting reaches
+// the program's environment. The build is real; see
+// TestHandleRunBatch.
+func TestRunProgramGODEBUG(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds programs")
+	}
+	var env []string
+	useRunner(t, runnerFunc(func(ctx context.Context, job runJob) (runResult, error) {
+		env = job.Env
+		return runResult{}, nil
+	}))
+	resp := runProgram(context.Background(), runRequest{Code: "package main\nfunc main() {}", GODEBUG: "gctrace=1"})
+	if resp.Error != "" {
+		t.Fatal(resp.Error)
+	}
+	if !slices.Contains(env, "GODEBUG=gctrace=1") {
+		t.Errorf("program environment %q, want GODEBUG=gctrace=1", env)
+	}
+}
+
+// children lists this process's children as "pid state" strings, read
+// from /proc.
+func children(t *testing.T) []string {
+	t.Helper()
+	stats, err := filepath.Glob("/proc/[0-9]*/stat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kids []string
+	for _, path := range stats {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue // exited since the glob
+		}
+		// pid (comm) state ppid ...; comm may itself contain spaces
+		// and parentheses.
+		stat := string(data)
+		fields := strings.Fields(stat[strings.LastIndex(stat, ")")+1:])
+		if len(fields) > 1 && fields[1] == strconv.Itoa(os.Getpid()) {
+			kids = append(kids, stat[:strings.Index(stat, " ")]+" "+fields[0])
+		}
+	}
+	return kids
+}
+
+// running reports whether process pid exists and isn't a zombie. A
+// zombie has been killed, and whether it is reaped is up to whoever
+// inherited it, which for an orphan is init rather than the server.
+func running(t *testing.T, pid int) bool {
+	t.Helper()
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return false
+	}
+	stat := string(data)
+	fields := strings.Fields(stat[strings.LastIndex(stat, ")")+1:])
+	return len(fields) > 0 && fields[0] != "Z"
+}
+
+// TestRunProgramReapsOnTimeout times out programs, some of which start
+// children of their own, and checks that no zombie or stray child of
+// the server is left behind, and that the grandchildren, which the
+// server never sees as children, are killed too. It builds and runs
+// real programs with the toolchain in GOROOT; see TestHandleRunBatch.
+func TestRunProgramReapsOnTimeout(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds programs")
+	}
+	if runtime.GOOS != "linux" {
+		t.Skip("reads /proc")
+	}
+	programs := []string{
+		"package main\nfunc main() { for {} }",
+		"package main\nimport (\"fmt\"; \"os\"; \"os/exec\"; \"time\")\nfunc main() { c := exec.Command(\"sleep\", \"60\"); c.Stdout = os.Stdout; c.Start(); fmt.Println(c.Process.Pid); for { time.Sleep(time.Millisecond) } }",
+	}
+	var pids []int
+	for i := range 4 {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		resp := runProgram(ctx, runRequest{Code: programs[i%len(programs)]})
+		cancel()
+		if resp.Error == "" {
+			t.Fatalf("run %d: want an error from the timeout, got output %q", i, resp.Output)
+		}
+		if i%len(programs) == 1 {
+			pid, err := strconv.Atoi(strings.TrimSpace(resp.Output))
+			if err != nil {
+				t.Fatalf("run %d: output %q isn't the sleep's PID", i, resp.Output)
+			}
+			pids = append(pids, pid)
+		}
+	}
+	if kids := children(t); len(kids) > 0 {
+		t.Errorf("children left after timed-out runs: %v", kids)
+	}
+	for _, pid := range pids {
+		if running(t, pid) {
+			t.Errorf("sleep %d started by a timed-out run is still running", pid)
+			syscall.Kill(pid, syscall.SIGKILL)
+		}
+	}
+}
+
+// TestHandleRunCancel checks that a run ends promptly, and its program
+// dies, when the client goes away. It builds and runs a real program
+// with the toolchain in GOROOT; see TestHandleRunBatch.
+func TestHandleRunCancel(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds programs")
+	}
+	if runtime.GOOS != "linux" {
+		t.Skip("reads /proc")
+	}
+	started := make(chan struct{})
+	useRunner(t, runnerFunc(func(ctx context.Context, job runJob) (runResult, error) {
+		close(started)
+		return localRunner{}.Run(ctx, job)
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	body := `{"code":"package main\nimport (\"fmt\"; \"os\")\nfunc main() { fmt.Println(os.Getpid()); for {} }"}`
+	req := httptest.NewRequest(http.MethodPost, "/api/run", strings.NewReader(body)).WithContext(ctx)
+	rec := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		handleRun(rec, req)
+		close(done)
+	}()
+
+	select {
+	case <-started:
+	case <-time.After(runTimeout):
+		t.Fatal("program never started")
+	}
+	time.Sleep(200 * time.Millisecond) // let it print its PID
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("handleRun still running 2s after the request was cancelled")
+	}
+
+	var resp runResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("%v: %s", err, rec.Body)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(resp.Output))
+	if err != nil {
+		t.Fatalf("output %q isn't the program's PID", resp.Output)
+	}
+	if resp.Error == "" {
+		t.Error("cancelled run reported no error")
+	}
+	if running(t, pid) {
+		t.Errorf("program %d is still running after the request was cancelled", pid)
+		syscall.Kill(pid, syscall.SIGKILL)
+	}
+}
+
+// TestRunProgramResources checks the resource use localRunner measures
+// for a program that touches 50 MiB and spins for 100ms. It builds and
+// runs a real program with the toolchain in GOROOT; see
+// TestHandleRunBatch.
+func TestRunProgramResources(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds programs")
+	}
+	if runtime.GOOS != "linux" {
+		t.Skip("peak RSS is only known to be in KiB on linux")
+	}
+	code := `package main
+
+import "time"
+
+var b []byte
+
+func main() {
+	b = make([]byte, 50<<20)
+	for i := range b {
+		b[i] = 1
+	}
+	for start := time.Now(); time.Since(start) < 100*time.Millisecond; {
+	}
+}
+`
+	resp := runProgram(context.Background(), runRequest{Code: code})
+	if resp.Error != "" {
+		t.Fatalf("Error = %q; output:\n%s", resp.Error, resp.Output)
+	}
+	if resp.MaxRSSKB < 50<<10 || resp.MaxRSSKB > 200<<10 {
+		t.Errorf("MaxRSSKB = %d, want 50 MiB to 200 MiB", resp.MaxRSSKB)
+	}
+	if resp.UserMS <= 0 || resp.SysMS <= 0 {
+		t.Errorf("UserMS = %d, SysMS = %d, want both > 0", resp.UserMS, resp.SysMS)
+	}
+}
+
+// TestHandleRunRace builds and runs a racy program with the toolchain
+// in GOROOT; see TestHandleRunBatch. It is skipped where the toolchain
+// can't build with -race.
+func TestHandleRunRace(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds programs")
+	}
+	code := `package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+func main() {
+	n := 0
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Add(1)
+		go func() { n++; wg.Done() }()
+	}
+	wg.Wait()
+	fmt.Println(n)
+}
+`
+	body, _ := json.Marshal(runRequest{Code: code, Mode: "race"})
+	rec := httptest.NewRecorder()
+	handleRun(rec, httptest.NewRequest(http.MethodPost, "/api/run", strings.NewReader(string(body))))
+	var resp runResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("%v: %s", err, rec.Body)
+	}
+	if strings.HasPrefix(resp.Error, "race detector unavailable") {
+		t.Skip(resp.Error)
+	}
+	if resp.Error != "data race detected" || !strings.Contains(resp.Output, "WARNING: DATA RACE") {
+		t.Errorf("Error = %q, want a race report; output:\n%s", resp.Error, resp.Output)
+	}
+}
+
+func TestNormalizeNewlines(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"", ""},
+		{"a\nb\n", "a\nb\n"},
+		{"a\r\nb\r\n", "a\nb\n"},
+		{"mixed\r\nends\n", "mixed\nends\n"},
+		{"progress\r50%\n", "progress\r50%\n"}, // a lone CR isn't a line ending
+		{"\r\r\n", "\r\n"},
+	}
+	for _, tt := range tests {
+		if got := normalizeNewlines(tt.in); got != tt.want {
+			t.Errorf("normalizeNewlines(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+// TestRunProgramNewlines checks CRLF source end to end and that KeepCR
+// leaves carriage returns in the output. It builds and runs real
+// programs with the toolchain in GOROOT; see TestHandleRunBatch.
+func TestRunProgramNewlines(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds programs")
+	}
+	resp := runProgram(context.Background(), runRequest{Code: "package main\r\n\r\nfunc main() { undefined() }\r\n"})
+	if len(resp.Diagnostics) != 1 || resp.Diagnostics[0].Line != 3 || resp.Diagnostics[0].Col != 15 {
+		t.Errorf("CRLF source: diagnostics %+v, want one at 3:15; output:\n%s", resp.Diagnostics, resp.Output)
+	}
+
+	const progress = "package main\nimport \"fmt\"\nfunc main() { fmt.Print(\"10%\\r100%\\n\") }\n"
+	for keep, want := range map[bool]string{false: "100%\n", true: "10%\r100%\n"} {
+		resp := runProgram(context.Background(), runRequest{Code: progress, KeepCR: keep})
+		if resp.Error != "" || resp.Output != want {
+			t.Errorf("KeepCR %v: Error = %q, output = %q, want output %q", keep, resp.Error, resp.Output, want)
+		}
+	}
+}
+
+func TestCheckImports(t *testing.T) {
+	blocked := blockedImports
+	blockedImports = append(slices.Clip(blocked), "os/exec")
+	t.Cleanup(func() { blockedImports = blocked })
+
+	tests := []struct {
+		name string
+		src  string
+		want diagnostic
+		ok   bool
+	}{
+		{"allowed", "package main\nimport \"fmt\"\nfunc main() { fmt.Println() }", diagnostic{}, false},
+		{
+			"unsafe",
+			"package main\n\nimport \"unsafe\"\n\nfunc main() { _ = unsafe.Sizeof(0) }",
+			diagnostic{3, 8, `import "unsafe" is not allowed in the playground`},
+			true,
+		},
+		{
+			"grouped and renamed",
+			"package main\nimport (\n\t\"fmt\"\n\tdbg \"runtime/debug\"\n)\nfunc main() { fmt.Println(dbg.SetMaxStack) }",
+			diagnostic{4, 6, `import "runtime/debug" is not allowed in the playground`},
+			true,
+		},
+		{"cgo", "package main\nimport \"C\"\nfunc main() {}", diagnostic{2, 8, `import "C" is not allowed in the playground`}, true},
+		{"extended", "package main\nimport _ \"os/exec\"", diagnostic{2, 10, `import "os/exec" is not allowed in the playground`}, true},
+		{"prefix only", "package main\nimport \"unsafe/x\"", diagnostic{}, false},
+		{"does not parse", "package main\nimport \"unsafe\nfunc main() {}", diagnostic{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := checkImports(tt.src)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("checkImports = %v, %t; want %v, %t", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestWithRequestID(t *testing.T) {
+	var seen []string
+	h := withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = append(seen, requestID(r.Context()))
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	var sent []string
+	for range 2 {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		if rec.Code != http.StatusTeapot {
+			t.Errorf("status = %d, want %d", rec.Code, http.StatusTeapot)
+		}
+		sent = append(sent, rec.Header().Get("X-Request-ID"))
+	}
+	if !slices.Equal(seen, sent) {
+		t.Errorf("handler saw IDs %v, header sent %v", seen, sent)
+	}
+	if sent[0] == "" || sent[0] == sent[1] {
+		t.Errorf("IDs %v, want two distinct non-empty IDs", sent)
+	}
+	if id := requestID(context.Background()); id != "" {
+		t.Errorf("requestID outside a request = %q, want \"\"", id)
+	}
+}
+
+// runnerFunc adapts a function to the runner interface.
+type runnerFunc func(ctx context.Context, job runJob) (runResult, error)
+
+func (f runnerFunc) Run(ctx context.Context, job runJob) (runResult, error) { return f(ctx, job) }
+
+// useRunner makes r the programRunner for the rest of the test.
+func useRunner(t *testing.T, r runner) {
+	saved := programRunner
+	programRunner = r
+	t.Cleanup(func() { programRunner = saved })
+}
+
+// TestRunnerContract checks, with a runner that plays the program's
+// part, what runProgram hands a runner and how it reports what the
+// runner returns. The builds are real; see TestHandleRunBatch.
+func TestRunnerContract(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds programs")
+	}
+	tests := []struct {
+		name   string
+		output string
+		result runResult
+		err    error
+		want   runResponse
+	}{
+		{
+			name:   "ok",
+			output: "hi\n",
+			result: runResult{Elapsed: 1500 * time.Millisecond, MaxRSSKB: 2048, User: 700 * time.Millisecond, Sys: 300 * time.Millisecond},
+			want:   runResponse{Output: "hi\n", ExecMS: 1500, MaxRSSKB: 2048, UserMS: 700, SysMS: 300},
+		},
+		{
+			name:   "truncated",
+			output: strings.Repeat("x", outputLimit+10),
+			want:   runResponse{Output: strings.Repeat("x", outputLimit), Truncated: true, Omitted: 10},
+		},
+		{
+			name:   "exit status",
+			output: "panic: boom\n",
+			err:    errors.New("exit status 2"),
+			want:   runResponse{Output: "panic: boom\n", Error: "exit status 2"},
+		},
+		{
+			name:   "deadlock",
+			output: deadlockMsg + "\n",
+			err:    errors.New("exit status 2"),
+			want:   runResponse{Output: deadlockMsg + "\n", Error: "program deadlocked: all goroutines are blocked"},
+		},
+		{
+			name:   "race",
+			output: raceMsg + "\n",
+			err:    errors.New("exit status 66"),
+			want:   runResponse{Output: raceMsg + "\n", Error: "data race detected"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useRunner(t, runnerFunc(func(ctx context.Context, job runJob) (runResult, error) {
+				if job.Binary != filepath.Join(job.Dir, binName) {
+					t.Errorf("Binary = %q, want %s in Dir %q", job.Binary, binName, job.Dir)
+				}
+				if _, err := os.Stat(job.Binary); err != nil {
+					t.Errorf("binary not built: %v", err)
+				}
+				if want := "GOMAXPROCS=" + strconv.Itoa(childMaxProcs); !slices.Contains(job.Env, want) {
+					t.Errorf("Env = %q, want %s", job.Env, want)
+				}
+				// The build has used a little of runTimeout by now.
+				if deadline, ok := ctx.Deadline(); !ok || time.Until(deadline) > runTimeout || time.Until(deadline) < runTimeout-10*time.Second {
+					t.Errorf("deadline in %v, want a little under runTimeout (%v)", time.Until(deadline), runTimeout)
+				}
+				fmt.Fprint(job.Output, tt.output)
+				return tt.result, tt.err
+			}))
+			got := runProgram(context.Background(), runRequest{Code: "package main\nfunc main() {}"})
+			got.CompileMS = 0
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("runProgram = %+v\nwant %+v", abbrev(got), abbrev(tt.want))
+			}
+		})
+	}
+
+	t.Run("timeout", func(t *testing.T) {
+		useRunner(t, runnerFunc(func(ctx context.Context, job runJob) (runResult, error) {
+			<-ctx.Done()
+			return runResult{}, errors.New("signal: killed")
+		}))
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		got := runProgram(ctx, runRequest{Code: "package main\nfunc main() {}"})
+		if !strings.HasPrefix(got.Error, "program timed out") {
+			t.Errorf("Error = %q, want program timed out", got.Error)
+		}
+	})
+}
+
+// abbrev shortens resp's output for printing.
+func abbrev(resp runResponse) runResponse {
+	if len(resp.Output) > 40 {
+		resp.Output = resp.Output[:40] + "..."
+	}
+	return resp
+}
+
+func TestIntEnv(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int
+	}{
+		{"", 7},
+		{"3", 3},
+		{"0", 7},
+		{"-2", 7},
+		{"two", 7},
+	}
+	for _, tt := range tests {
+		t.Setenv("PLAYGROUND_TEST_INT", tt.value)
+		if got := intEnv("PLAYGROUND_TEST_INT", 7); got != tt.want {
+			t.Errorf("intEnv with %q = %d, want %d", tt.value, got, tt.want)
+		}
+	}
+}
+
+// TestChildGOMAXPROCS builds a real program with the toolchain in
+// GOROOT, then checks the environment the runner is given.
+func TestChildGOMAXPROCS(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds programs")
+	}
+	if os.Getenv("CHILD_GOMAXPROCS") == "" && childMaxProcs != 2 {
+		t.Errorf("default childMaxProcs = %d, want 2", childMaxProcs)
+	}
+	saved := childMaxProcs
+	t.Cleanup(func() { childMaxProcs = saved })
+
+	var env []string
+	useRunner(t, runnerFunc(func(ctx context.Context, job runJob) (runResult, error) {
+		env = job.Env
+		return runResult{}, nil
+	}))
+	for _, n := range []int{2, 5} {
+		childMaxProcs = n
+		env = nil
+		runProgram(context.Background(), runRequest{Code: "package main\nfunc main() {}"})
+		if want := "GOMAXPROCS=" + strconv.Itoa(n); !slices.Contains(env, want) {
+			t.Errorf("child env = %v, want it to contain %s", env, want)
+		}
+	}
+}
+
+// useGistServer points gist fetches at a local TLS server running h
+// and empties the gist cache, for the rest of the test.
+func useGistServer(t *testing.T, h http.HandlerFunc) {
+	srv := httptest.NewTLSServer(h)
+	savedAPI, savedClient := gistAPI, gistClient
+	gistAPI, gistClient = srv.URL+"/gists/", srv.Client()
+	gistCache.Lock()
+	gistCache.m = make(map[string]gistEntry)
+	gistCache.Unlock()
+	t.Cleanup(func() {
+		srv.Close()
+		gistAPI, gistClient = savedAPI, savedClient
+	})
+}
+
+func gistJSON(files map[string]string, size int) string {
+	type file struct {
+		Size    int    `json:"size"`
+		Content string `json:"content"`
+	}
+	m := map[string]file{}
+	for name, content := range files {
+		m[name] = file{cmp.Or(size, len(content)), content}
+	}
+	data, _ := json.Marshal(map[string]any{"files": m})
+	return string(data)
+}
+
+func TestFetchGistUncached(t *testing.T) {
+	useGistServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/gists/a1":
+			fmt.Fprint(w, gistJSON(map[string]string{"b.go": "package b", "a.go": "package a", "README": "x"}, 0))
+		case "/gists/a2":
+			http.NotFound(w, r)
+		case "/gists/a3":
+			fmt.Fprint(w, gistJSON(map[string]string{"big.go": "package big"}, gistMaxBytes+1))
+		case "/gists/a4":
+			fmt.Fprint(w, gistJSON(map[string]string{"notes.txt": "x"}, 0))
+		case "/gists/a5":
+			fmt.Fprint(w, "{")
+		}
+	})
+	tests := []struct {
+		id      string
+		want    string
+		wantErr string
+	}{
+		{"a1", "package a", ""},
+		{"a2", "", "GitHub returned 404 Not Found"},
+		{"a3", "", "big.go is larger than 65536 bytes"},
+		{"a4", "", "no .go file in gist"},
+		{"a5", "", "decoding gist"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			got, err := fetchGistUncached(context.Background(), tt.id)
+			if got != tt.want || (err == nil) != (tt.wantErr == "") || err != nil && !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("fetchGistUncached(%q) = %q, %v; want %q, error containing %q", tt.id, got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestFetchGistCachesFailures(t *testing.T) {
+	hits := 0
+	fail := true
+	useGistServer(t, func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		if fail {
+			http.Error(w, "down", http.StatusBadGateway)
+			return
+		}
+		fmt.Fprint(w, gistJSON(map[string]string{"a.go": "package a"}, 0))
+	})
+	if _, err := fetchGist(context.Background(), "b1"); err == nil {
+		t.Fatal("first fetch succeeded, want the server's error")
+	}
+	fail = false
+	if _, err := fetchGist(context.Background(), "b1"); err == nil || hits != 1 {
+		t.Errorf("second fetch: err = %v after %d requests; want the cached error after 1", err, hits)
+	}
+	if _, err := fetchGist(context.Background(), "not-hex"); err == nil || hits != 1 {
+		t.Errorf("invalid id: err = %v after %d requests; want an error without a request", err, hits)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	t.Cleanup(func() {
+		health.Lock()
+		health.checked, health.err = false, nil
+		health.Unlock()
+	})
+	status := func() int {
+		rec := httptest.NewRecorder()
+		handleHealth(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		return rec.Code
+	}
+
+	if got := status(); got != http.StatusServiceUnavailable {
+		t.Errorf("before the self-check: /healthz = %d, want 503", got)
+	}
+
+	// A toolchain that isn't there fails the self-check like a broken
+	// one does.
+	savedRoot := goToolchain
+	goToolchain = filepath.Join(t.TempDir(), "no-such-goroot")
+	err := buildWarmup()
+	goToolchain = savedRoot
+	if err == nil {
+		t.Fatal("buildWarmup succeeded without a toolchain")
+	}
+	setHealth(err)
+	if got := status(); got != http.StatusServiceUnavailable {
+		t.Errorf("after a failed self-check: /healthz = %d, want 503", got)
+	}
+	resp := runProgram(context.Background(), runRequest{Code: "package main\nfunc main() {}"})
+	if !strings.HasPrefix(resp.Error, "playground unavailable") {
+		t.Errorf("run after a failed self-check: Error = %q, want playground unavailable", resp.Error)
+	}
+	rec := httptest.NewRecorder()
+	handleVet(rec, httptest.NewRequest(http.MethodPost, "/api/vet", strings.NewReader(`{"code":"package main"}`)))
+	if !strings.Contains(rec.Body.String(), "playground unavailable") {
+		t.Errorf("vet after a failed self-check: %s, want playground unavailable", rec.Body)
+	}
+
+	setHealth(nil)
+	if got := status(); got != http.StatusOK {
+		t.Errorf("after a passing self-check: /healthz = %d, want 200", got)
+	}
+}
+
+func TestDefaultTheme(t *testing.T) {
+	for in, want := range map[string]string{"": "dark", "dark": "dark", "light": "light", "Light": "dark", "solarized": "dark"} {
+		if got := themeEnv(in); got != want {
+			t.Errorf("themeEnv(%q) = %q, want %q", in, got, want)
+		}
+	}
+
+	saved := defaultTheme
+	t.Cleanup(func() { defaultTheme = saved })
+	for _, theme := range []string{"light", "dark"} {
+		defaultTheme = theme
+		rec := httptest.NewRecorder()
+		handleIndex(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		if want := `<html lang="en" class="` + theme + `">`; !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("DEFAULT_THEME=%s: page has no %s", theme, want)
+		}
+	}
+}
+
+func TestHandleEmbed(t *testing.T) {
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{"?example=1", http.StatusOK},
+		{"?example=99", http.StatusNotFound},
+		{"?example=-1", http.StatusNotFound},
+		{"?example=x", http.StatusNotFound},
+		{"", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		handleEmbed(rec, httptest.NewRequest(http.MethodGet, "/embed"+tt.query, nil))
+		if rec.Code != tt.want {
+			t.Errorf("/embed%s: status %d, want %d", tt.query, rec.Code, tt.want)
+			continue
+		}
+		if rec.Code != http.StatusOK {
+			continue
+		}
+		page := rec.Body.String()
+		if strings.Contains(page, `<select id="examples"`) {
+			t.Errorf("/embed%s has an examples menu", tt.query)
+		}
+		if !strings.Contains(page, `const embed = true;`) {
+			t.Errorf("/embed%s isn't rendered in embed mode", tt.query)
+		}
+		pre, _ := json.Marshal(&preload{Code: examples[1].Code})
+		if !strings.Contains(page, "const preload = "+string(pre)+";") {
+			t.Errorf("/embed%s doesn't preload example 1", tt.query)
+		}
+	}
+}
+
+// TestQuantumValidate runs the embedded validation suite through
+// handleRun, as a visitor picking it from the examples menu would.
+func TestQuantumValidate(t *testing.T) {
+	needDecimal(t)
+	if testing.Short() {
+		t.Skip("builds programs")
+	}
+	body, _ := json.Marshal(runRequest{Code: quantumValidateSrc})
+	rec := httptest.NewRecorder()
+	handleRun(rec, httptest.NewRequest(http.MethodPost, "/api/run", strings.NewReader(string(body))))
+	var resp runResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("%v: %s", err, rec.Body)
+	}
+	if resp.Error != "" || strings.Contains(resp.Output, "FAIL") || !strings.Contains(resp.Output, "all 32 tests passed") {
+		t.Errorf("Error = %q, want all 32 tests to pass; output:\n%s", resp.Error, resp.Output)
+	}
+}
+
+// TestRunSlots fires three times as many runs as there are slots and
+// checks, with a runner that records how many jobs it holds at once,
+// that the slots bound concurrent executions without failing any run.
+// The builds are real; see TestHandleRunBatch.
+func TestRunSlots(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds programs")
+	}
+	var mu sync.Mutex
+	running, peak := 0, 0
+	useRunner(t, runnerFunc(func(ctx context.Context, job runJob) (runResult, error) {
+		mu.Lock()
+		running++
+		peak = max(peak, running)
+		mu.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return runResult{}, nil
+	}))
+
+	var wg sync.WaitGroup
+	for i := range 3 * cap(runSlots) {
+		wg.Go(func() {
+			code := fmt.Sprintf("package main\nfunc main() { println(%d) }", i)
+			if resp := runProgram(context.Background(), runRequest{Code: code}); resp.Error != "" {
+				t.Errorf("run %d: %s", i, resp.Error)
+			}
+		})
+	}
+	wg.Wait()
+	if peak < 1 || peak > cap(runSlots) {
+		t.Errorf("peak of %d concurrent runs, want 1 to %d", peak, cap(runSlots))
+	}
+}
+
+// TestDumpMarker checks that the helpers' output and renderOutput agree
+// on the marker that starts a dump line.
+func TestDumpMarker(t *testing.T) {
+	esc := strings.Trim(strconv.QuoteToASCII(dumpMarker), `"`)
+	for name, src := range map[string]string{"dumpSrc": dumpSrc, "deltaSrc": deltaSrc} {
+		if !strings.Contains(src, `fmt.Printf("`+esc+`{`) {
+			t.Errorf("%s doesn't print lines starting with %s", name, esc)
+		}
+	}
+	if !strings.Contains(indexHTML, `line.charAt(0) === '`+esc+`'`) {
+		t.Errorf("renderOutput doesn't look for lines starting with %s", esc)
+	}
+}
+
+// TestDecimalDump runs decimal.Dump and checks the line it prints:
+// 1.50 is coefficient 150 at exponent -2, biased to 396 in bits 53-62.
+func TestDecimalDump(t *testing.T) {
+	needDecimal(t)
+	if testing.Short() {
+		t.Skip("builds programs")
+	}
+	resp := runProgram(context.Background(), runRequest{Code: "package main\nfunc main() { decimal.Dump(1.50) }"})
+	want := dumpMarker + `{"value":"1.50","coeff":"150","exp":-2,"bits":"0x3180000000000096"}` + "\n"
+	if resp.Error != "" || resp.Output != want {
+		t.Errorf("Error = %q, output = %q; want output %q", resp.Error, resp.Output, want)
+	}
+}
+
+func TestDeltaInstrument(t *testing.T) {
+	for name, src := range map[string]string{
+		"float only":     "package main\nfunc main() { a, b := 0.1, 0.2; println(a + b) }\n",
+		"integers":       "package main\nfunc main() { n := 1; println(n + 2) }\n",
+		"does not parse": "package main\nfunc main() { 0.1 + }\n",
+		"constant":       "package main\nconst c = 0.1 + 0.2\nfunc main() { println(c) }\n",
+	} {
+		if got := deltaInstrument(src); got != src {
+			t.Errorf("%s: deltaInstrument(%q) = %q, want it unchanged", name, src, got)
+		}
+	}
+}
+
+// TestDeltaInstrumentDecimal checks the rewrite of decimal arithmetic,
+// then runs it to check that 0.1 + 0.2 is reported as differing from
+// float64's result.
+func TestDeltaInstrumentDecimal(t *testing.T) {
+	needDecimal(t)
+	src := `package main
+
+import "fmt"
+
+func main() {
+	a, b := decimal64(0.1), decimal64(0.2)
+	fmt.Println(a + b)
+}
+`
+	got := deltaInstrument(src)
+	if !strings.Contains(got, `_playgroundDelta64(7, "a + b", a + b, (float64(a) + float64(b)))`) {
+		t.Errorf("deltaInstrument didn't instrument a + b:\n%s", got)
+	}
+	if _, err := parser.ParseFile(token.NewFileSet(), srcName, got, 0); err != nil {
+		t.Errorf("rewrite doesn't parse: %v\n%s", err, got)
+	}
+	if strings.Count(got, "\n") != strings.Count(src, "\n") {
+		t.Errorf("deltaInstrument changed the line count")
+	}
+
+	if testing.Short() {
+		t.Skip("builds programs")
+	}
+	resp := runProgram(context.Background(), runRequest{Code: src, Mode: "deltas"})
+	if resp.Error != "" {
+		t.Fatalf("Error = %q; output:\n%s", resp.Error, resp.Output)
+	}
+	// As renderOutput does, treat any spelling of zero as no difference.
+	zeroDiff := regexp.MustCompile(`^-?0(e[-+]?\d+)?$`)
+	line, _, _ := strings.Cut(resp.Output, "\n")
+	var delta struct {
+		Decimal, Float string
+		Diff           *string
+	}
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(line, dumpMarker)), &delta); err != nil {
+		t.Fatalf("first line %q isn't a delta report: %v", line, err)
+	}
+	if delta.Decimal != "0.3" || delta.Float != "0.30000000000000004" || delta.Diff == nil || zeroDiff.MatchString(*delta.Diff) {
+		t.Errorf("delta = %+v, want decimal 0.3, float 0.30000000000000004 and a nonzero diff", delta)
+	}
+}
@@ -5,9 +5,14 @@ package main
 
 import (
 	"fmt"
+	htmltemplate "html/template"
+	"log/slog"
 	"math"
 	"os"
+	"reflect"
+	"strconv"
 	"strings"
+	"text/template"
 )
 
 var failures int
@@ -23,6 +28,20 @@ func check(name, got, want string) {
 	}
 }
 
+// bid64 decodes the coefficient and unbiased exponent of a finite
+// decimal64 from its BID encoding, handling both coefficient forms.
+func bid64(d decimal64) (coeff uint64, exp int) {
+	bits := math.Decimal64bits(d)
+	if bits>>61&3 == 3 {
+		exp = int((bits>>51)&0x3FF) - 398
+		coeff = 1<<53 | bits&((1<<51)-1)
+	} else {
+		exp = int((bits>>53)&0x3FF) - 398
+		coeff = bits & ((1 << 53) - 1)
+	}
+	return coeff, exp
+}
+
 func main() {
 	// 1. Literal quantum preservation: decimal64(1.50) should keep 3 sig digits.
 	d := decimal64(1.50)
@@ -47,9 +66,7 @@ func main() {
 		fmt.Sprintf("%g", product), "1.8")
 
 	// 6. Verify BID64 encoding directly: coeff=18000, exp=-4.
-	bits := math.Decimal64bits(product)
-	exp := int((bits>>53)&0x3FF) - 398
-	coeff := bits & ((1 << 53) - 1)
+	coeff, exp := bid64(product)
 	check("bid64 coeff", fmt.Sprintf("%d", coeff), "18000")
 	check("bid64 exp", fmt.Sprintf("%d", exp), "-4")
 
@@ -114,9 +131,277 @@ func main() {
 	check("sub quantum 3.5-0.00",
 		fmt.Sprintf("%#g", decimal64(3.5)-decimal64(0.00)), "3.50")
 
+	// 19. int64 conversion beyond 16 digits rounds half-even, not truncates.
+	// 12345678901234567 → 1234567890123457e1.
+	var n17 int64 = 12345678901234567
+	coeff, exp = bid64(decimal64(n17))
+	check("int64 17-digit coeff", fmt.Sprintf("%d", coeff), "1234567890123457")
+	check("int64 17-digit exp", fmt.Sprintf("%d", exp), "1")
+
+	// 20. MaxInt64 (19 digits) rounds up: 9223372036854775|807 → ...776e3.
+	var maxInt int64 = math.MaxInt64
+	coeff, exp = bid64(decimal64(maxInt))
+	check("int64 max coeff", fmt.Sprintf("%d", coeff), "9223372036854776")
+	check("int64 max exp", fmt.Sprintf("%d", exp), "3")
+
+	// 21. Negative zero: 0 * -1 yields -0, which formats like float64's -0,
+	// including under the + and space flags.
+	var zero decimal64
+	negZero := zero * -1
+	fnegZero := math.Copysign(0, -1)
+	check("neg zero %%g",
+		fmt.Sprintf("%g", negZero), fmt.Sprintf("%g", fnegZero))
+	check("neg zero %%#g",
+		fmt.Sprintf("%#g", negZero), "-0")
+	check("neg zero %%+g",
+		fmt.Sprintf("%+g", negZero), fmt.Sprintf("%+g", fnegZero))
+	check("neg zero %% g",
+		fmt.Sprintf("% g", negZero), fmt.Sprintf("% g", fnegZero))
+	check("pos zero %%+g",
+		fmt.Sprintf("%+g", zero), "+0")
+
+	// 22. decimal128 parity: a computation whose only rounding step is the
+	// final division agrees with decimal64 once narrowed.
+	// (19.99*3 + 4.50*12) * 1.0825 / 7 = 17.62464642857142857...
+	sub64 := decimal64(19.99)*3 + decimal64(4.50)*12
+	sub128 := decimal128(19.99)*3 + decimal128(4.50)*12
+	check("d128 parity",
+		fmt.Sprintf("%g", decimal64(sub128*1.0825/7)),
+		fmt.Sprintf("%g", sub64*1.0825/7))
+	check("d128 parity value",
+		fmt.Sprintf("%g", sub64*1.0825/7), "17.62464642857143")
+
+	// 23. Exponent notation shifts the decimal point without changing the
+	// coefficient: "1.50e2" is 150×10^0 and "150e-2" is 150×10^-2.
+	// Literals follow the same rule as the parser.
+	for _, tc := range []struct {
+		src   string
+		lit   decimal64
+		coeff uint64
+		exp   int
+	}{
+		{"1.50e2", 1.50e2, 150, 0},
+		{"150e-2", 150e-2, 150, -2},
+	} {
+		p, err := strconv.ParseDecimal64(tc.src)
+		if err != nil {
+			check("parse "+tc.src, err.Error(), "<nil>")
+			continue
+		}
+		coeff, exp = bid64(p)
+		check("parse "+tc.src+" coeff", fmt.Sprintf("%d", coeff), fmt.Sprintf("%d", tc.coeff))
+		check("parse "+tc.src+" exp", fmt.Sprintf("%d", exp), fmt.Sprintf("%d", tc.exp))
+		coeff, exp = bid64(tc.lit)
+		check("literal "+tc.src+" coeff", fmt.Sprintf("%d", coeff), fmt.Sprintf("%d", tc.coeff))
+		check("literal "+tc.src+" exp", fmt.Sprintf("%d", exp), fmt.Sprintf("%d", tc.exp))
+	}
+
+	// 24. Templates render decimals through fmt: {{.Total}} matches
+	// fmt.Sprint and printf verbs apply as in Go code.
+	invoice := struct{ Total decimal64 }{decimal64(19.90) * 3}
+	for _, tc := range []struct{ name, tmpl, want string }{
+		{"{{.Total}}", "{{.Total}}", fmt.Sprint(invoice.Total)},
+		{"printf %%.2f", `{{printf "%.2f" .Total}}`, "59.70"},
+		{"printf %%#g", `{{printf "%#g" .Total}}`, "59.70"},
+	} {
+		var text, html strings.Builder
+		err := template.Must(template.New("t").Parse(tc.tmpl)).Execute(&text, invoice)
+		if err != nil {
+			check("text/template "+tc.name, err.Error(), "<nil>")
+			continue
+		}
+		check("text/template "+tc.name, text.String(), tc.want)
+		err = htmltemplate.Must(htmltemplate.New("t").Parse(tc.tmpl)).Execute(&html, invoice)
+		if err != nil {
+			check("html/template "+tc.name, err.Error(), "<nil>")
+			continue
+		}
+		check("html/template "+tc.name, html.String(), tc.want)
+	}
+
+	// 25. slog's JSON handler logs decimals as JSON numbers in their
+	// canonical form, as encoding/json does, not as a bit pattern.
+	var logged strings.Builder
+	attrsOnly := &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && (a.Key == slog.TimeKey || a.Key == slog.LevelKey || a.Key == slog.MessageKey) {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}
+	logger := slog.New(slog.NewJSONHandler(&logged, attrsOnly))
+	logger.Info("", slog.Any("total", decimal64(19.99)))
+	check("slog JSON decimal64", logged.String(), `{"total":19.99}`)
+	logged.Reset()
+	logger.Info("", "total", decimal128(19.99))
+	check("slog JSON decimal128", logged.String(), `{"total":19.99}`)
+
+	// 26. A large-form encoding whose coefficient is at least 10^16 is
+	// non-canonical and means zero with the encoded exponent. It must
+	// format, compare and hash exactly like the canonical zero.
+	const big = 10000000000000000 - 1<<53
+	nonCanon := math.Decimal64frombits(3<<61 | 398<<51 | big)
+	canon := math.Decimal64frombits(398 << 53)
+	check("non-canonical %%g", fmt.Sprintf("%g", nonCanon), fmt.Sprintf("%g", canon))
+	check("non-canonical %%#g", fmt.Sprintf("%#g", nonCanon), fmt.Sprintf("%#g", canon))
+	check("non-canonical == 0", fmt.Sprint(nonCanon == 0), "true")
+	check("non-canonical == canonical", fmt.Sprint(nonCanon == canon), "true")
+	check("non-canonical + 1", fmt.Sprintf("%#g", nonCanon+1), "1")
+	zeros := map[decimal64]string{canon: "zero"}
+	check("non-canonical map key", zeros[nonCanon], "zero")
+
+	// 27. reflect reports the decimal kinds by name, and reading and
+	// writing a decimal field through reflect keeps every bit,
+	// including the quantum.
+	var row struct {
+		Price decimal64
+		Total decimal128
+	}
+	rv := reflect.ValueOf(&row).Elem()
+	check("reflect kind decimal64", rv.Field(0).Kind().String(), "decimal64")
+	check("reflect kind decimal128", rv.Field(1).Kind().String(), "decimal128")
+	unit := decimal64(19.90)
+	rv.Field(0).Set(reflect.ValueOf(unit))
+	check("reflect set bits", fmt.Sprintf("%#x", math.Decimal64bits(row.Price)),
+		fmt.Sprintf("%#x", math.Decimal64bits(unit)))
+	got, ok := rv.Field(0).Interface().(decimal64)
+	check("reflect Interface type", fmt.Sprint(ok), "true")
+	check("reflect Interface bits", fmt.Sprintf("%#x", math.Decimal64bits(got)),
+		fmt.Sprintf("%#x", math.Decimal64bits(unit)))
+	check("reflect Interface quantum", fmt.Sprintf("%#g", got), "19.90")
+
+	// 28. Every rounding operation breaks exact ties to the even
+	// coefficient. Operands are variables so the runtime, not the
+	// compiler, does the rounding.
+	var (
+		all9s  decimal64 = 9999999999999999
+		all9s7 decimal64 = 9999999999999997
+		odd1   decimal64 = 2000000000000001
+		odd3   decimal64 = 2000000000000003
+		frac9s decimal64 = 0.9999999999999999
+		two    decimal64 = 2
+		five   decimal64 = 5
+		tie1   int64     = 12345678901234565
+		tie2   int64     = 12345678901234575
+	)
+	type tie struct {
+		name  string
+		got   decimal64
+		coeff uint64
+		exp   int
+	}
+	ties := []tie{
+		{"div 9999999999999999/2", all9s / two, 5000000000000000, 0},
+		{"div 9999999999999997/2", all9s7 / two, 4999999999999998, 0},
+		{"div 0.9999999999999999/2", frac9s / two, 5000000000000000, -16},
+		{"mul 2000000000000001*5", odd1 * five, 1000000000000000, 1},
+		{"mul 2000000000000003*5", odd3 * five, 1000000000000002, 1},
+		{"int64 12345678901234565", decimal64(tie1), 1234567890123456, 1},
+		{"int64 12345678901234575", decimal64(tie2), 1234567890123458, 1},
+		{"quantize 0.5 to 1", math.Quantize64(0.5, 1), 0, 0},
+		{"quantize 2.5 to 1", math.Quantize64(2.5, 1), 2, 0},
+		{"quantize 0.05 to 0.1", math.Quantize64(0.05, 0.1), 0, -1},
+		{"quantize 0.25 to 0.1", math.Quantize64(0.25, 0.1), 2, -1},
+		{"RoundToEven64 0.5", math.RoundToEven64(0.5), 0, 0},
+		{"RoundToEven64 2.5", math.RoundToEven64(2.5), 2, 0},
+	}
+	if p, err := strconv.ParseDecimal64("12345678901234565"); err == nil {
+		ties = append(ties, tie{"parse 12345678901234565", p, 1234567890123456, 1})
+	} else {
+		check("parse 12345678901234565", err.Error(), "<nil>")
+	}
+	for _, tc := range ties {
+		coeff, exp = bid64(tc.got)
+		check("tie "+tc.name+" coeff", fmt.Sprintf("%d", coeff), fmt.Sprintf("%d", tc.coeff))
+		check("tie "+tc.name+" exp", fmt.Sprintf("%d", exp), fmt.Sprintf("%d", tc.exp))
+	}
+
+	// 29. Banker's rounding to cents. Each half-cent value is exact in
+	// decimal64, so Quantize64 sees a true tie and picks the even
+	// cent. float64 holds a binary approximation just above or below
+	// the tie, so which way it rounds depends on that error.
+	for _, tc := range []struct {
+		src   string
+		d     decimal64
+		f     float64
+		want  string
+		float string
+	}{
+		{"2.675", 2.675, 2.675, "2.68", "2.67"},
+		{"2.665", 2.665, 2.665, "2.66", "2.67"},
+		{"2.685", 2.685, 2.685, "2.68", "2.69"},
+		{"-2.675", -2.675, -2.675, "-2.68", "-2.67"},
+		{"1.005", 1.005, 1.005, "1.00", "1.00"},
+		{"1.015", 1.015, 1.015, "1.02", "1.01"},
+		{"0.125", 0.125, 0.125, "0.12", "0.12"},
+		{"0.135", 0.135, 0.135, "0.14", "0.14"},
+		{"0.005", 0.005, 0.005, "0.00", "0.01"},
+	} {
+		check("banker's "+tc.src, fmt.Sprintf("%#g", math.Quantize64(tc.d, 0.01)), tc.want)
+		check("float64 %%.2f "+tc.src, fmt.Sprintf("%.2f", tc.f), tc.float)
+	}
+
+	// 30. Exponent limits. The encoded exponent runs from -398 (Etiny)
+	// to 369 (Emax minus 15). Results below Etiny round at Etiny,
+	// half-even; large values clamp by padding the coefficient with
+	// zeros until they no longer fit, then overflow to infinity.
+	var tenth, ten decimal64 = 0.1, 10
+	for _, tc := range []struct {
+		name  string
+		got   decimal64
+		coeff uint64
+		exp   int
+	}{
+		{"1e-398 * 0.1", math.Decimal64frombits(1) * tenth, 0, -398},
+		{"5e-398 * 0.1", math.Decimal64frombits(5) * tenth, 0, -398},
+		{"15e-398 * 0.1", math.Decimal64frombits(15) * tenth, 2, -398},
+	} {
+		coeff, exp = bid64(tc.got)
+		check("etiny "+tc.name+" coeff", fmt.Sprintf("%d", coeff), fmt.Sprintf("%d", tc.coeff))
+		check("etiny "+tc.name+" exp", fmt.Sprintf("%d", exp), fmt.Sprintf("%d", tc.exp))
+	}
+	if huge, err := strconv.ParseDecimal64("1e384"); err == nil {
+		coeff, exp = bid64(huge)
+		check("clamp 1e384 coeff", fmt.Sprintf("%d", coeff), "1000000000000000")
+		check("clamp 1e384 exp", fmt.Sprintf("%d", exp), "369")
+	} else {
+		check("parse 1e384", err.Error(), "<nil>")
+	}
+	if largest, err := strconv.ParseDecimal64("9.999999999999999e384"); err == nil {
+		coeff, exp = bid64(largest)
+		check("max coeff", fmt.Sprintf("%d", coeff), "9999999999999999")
+		check("max exp", fmt.Sprintf("%d", exp), "369")
+		check("max * 10", fmt.Sprintf("%g", largest*ten), "+Inf")
+		check("-max * 10", fmt.Sprintf("%g", -largest*ten), "-Inf")
+	} else {
+		check("parse max", err.Error(), "<nil>")
+	}
+	check("quantize 1 to 1e-398", fmt.Sprintf("%g", math.Quantize64(1, math.Decimal64frombits(1))), "NaN")
+
+	// 31. Repeated addition doesn't drift: 0.01 added 10,000 times is
+	// exactly 100.00, keeping the cent quantum. The same loop in
+	// float64 ends at 100.00000000001425.
+	var cent, total decimal64 = 0.01, 0
+	for range 10000 {
+		total += cent
+	}
+	check("10000 x 0.01 %%#g", fmt.Sprintf("%#g", total), "100.00")
+	coeff, exp = bid64(total)
+	check("10000 x 0.01 coeff", fmt.Sprintf("%d", coeff), "10000")
+	check("10000 x 0.01 exp", fmt.Sprintf("%d", exp), "-2")
+	check("10000 x 0.01 == 100", fmt.Sprint(total == 100), "true")
+
+	// 32. slog's text handler formats decimals with %+v, which, as for
+	// float64, prints no sign on positive values.
+	logged.Reset()
+	logger = slog.New(slog.NewTextHandler(&logged, attrsOnly))
+	logger.Info("", "total", decimal64(19.99), "refund", decimal128(-0.5))
+	check("slog text decimals", logged.String(), "total=19.99 refund=-0.5\n")
+
 	if failures > 0 {
 		fmt.Fprintf(os.Stderr, "\n%d test(s) FAILED\n", failures)
 		os.Exit(1)
 	}
-	fmt.Printf("\nall %d tests passed\n", 18)
+	fmt.Printf("\nall %d tests passed\n", 32)
 }